@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// adaptiveStyle shows the dark variant by default and the light one, made for
+// dark backgrounds, when the viewer prefers a dark color scheme.
+const adaptiveStyle = `<style>.adaptive-light{display:none}@media (prefers-color-scheme:dark){.adaptive-dark{display:none}.adaptive-light{display:inline}}</style>`
+
+var (
+	urlRefRe      = regexp.MustCompile(`url\(\s*(['"]?)#([^'")\s]+)`)
+	cssSelectorRe = regexp.MustCompile(`([.#])(-?[_a-zA-Z\x80-\xff][\w\x80-\xff-]*)`)
+)
+
+// lookupAdaptive loads the light and dark variants of an icon as SVG and
+// merges them into one.
+func lookupAdaptive(ctx context.Context, baseName string) (iconResult, error) {
+	light, err := lookupIcon(ctx, baseName+"-light", iconRecolor{}, []string{"svg"})
+	if err != nil {
+		return iconResult{}, err
+	}
+	dark, err := lookupIcon(ctx, baseName+"-dark", iconRecolor{}, []string{"svg"})
+	if err != nil {
+		return iconResult{}, err
+	}
+
+	merged, err := mergeAdaptiveSVG(light.Content, dark.Content)
+	if err != nil {
+		return iconResult{}, &renderError{message: "Failed to merge icon variants", err: err}
+	}
+	source := light.Source
+	if dark.Source != source {
+		source += ", " + dark.Source
+	}
+	// With two origins the result can't be revalidated, only reloaded
+	return iconResult{Content: merged, Format: "svg", Source: source, MaxAge: min(light.MaxAge, dark.MaxAge)}, nil
+}
+
+// mergeAdaptiveSVG combines the light and dark variants of an icon into a
+// single SVG that switches between them with a prefers-color-scheme media
+// query. Each variant is nested in an <svg> element of its own, keeping its
+// viewBox and root attributes, and has its IDs, class names and stylesheet
+// rules prefixed so the two can't interfere.
+func mergeAdaptiveSVG(light, dark string) (string, error) {
+	darkNested, darkRoot, err := nestVariant(dark, "dark")
+	if err != nil {
+		return "", err
+	}
+	lightNested, _, err := nestVariant(light, "light")
+	if err != nil {
+		return "", err
+	}
+
+	// The combined icon takes its dimensions from the dark variant
+	var b strings.Builder
+	b.WriteString(`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"`)
+	rewriteAttrs(darkRoot, func(name, value string) (string, bool) {
+		switch name {
+		case "viewbox":
+			fmt.Fprintf(&b, ` viewBox="%s"`, value)
+		case "width", "height":
+			fmt.Fprintf(&b, ` %s="%s"`, name, value)
+		}
+		return value, true
+	})
+	b.WriteString(">")
+	b.WriteString(adaptiveStyle)
+	b.WriteString(darkNested)
+	b.WriteString(lightNested)
+	b.WriteString("</svg>")
+
+	merged := b.String()
+	if err := validateSVG(merged); err != nil {
+		return "", err
+	}
+	return merged, nil
+}
+
+// nestVariant rewrites a variant as an <svg> element of class
+// adaptive-{name}, prefixing its identifiers with "{name}-". It also returns
+// the original root tag.
+func nestVariant(svg, name string) (nested, root string, err error) {
+	start, end := rootSVGTag(svg)
+	if start < 0 {
+		return "", "", errors.New("no root svg element in " + name + " variant")
+	}
+	root = svg[start:end]
+	body := ""
+	if !strings.HasSuffix(root, "/>") {
+		close := strings.LastIndex(svg, "</svg>")
+		if close < end {
+			return "", "", errors.New("unterminated root svg element in " + name + " variant")
+		}
+		body = svg[end:close]
+	}
+
+	p := variantPrefixer{prefix: name + "-", ids: make(map[string]bool)}
+	walkSVG(svg, func(tag string) string {
+		rewriteAttrs(tag, func(attr, value string) (string, bool) {
+			if attr == "id" {
+				p.ids[value] = true
+			}
+			return value, true
+		})
+		return tag
+	}, func(css string) string { return css })
+
+	// The root's classes move onto the nested element next to the one that
+	// toggles it; its size comes from the combined root
+	class := "adaptive-" + name
+	nestedRoot := rewriteAttrs(root, func(attr, value string) (string, bool) {
+		switch attr {
+		case "class":
+			class += " " + p.classes(value)
+			return "", false
+		case "width", "height", "x", "y":
+			return "", false
+		}
+		return p.attr(attr, value), true
+	})
+	nestedRoot = `<svg class="` + class + `"` + strings.TrimPrefix(nestedRoot, "<svg")
+
+	nestedBody := walkSVG(body, func(tag string) string {
+		return rewriteAttrs(tag, func(attr, value string) (string, bool) {
+			return p.attr(attr, value), true
+		})
+	}, func(css string) string {
+		return p.css(css, ".adaptive-"+name)
+	})
+
+	if strings.HasSuffix(root, "/>") {
+		return nestedRoot, root, nil
+	}
+	return nestedRoot + nestedBody + "</svg>", root, nil
+}
+
+// variantPrefixer renames the identifiers of one variant of a merged icon.
+// Only IDs defined in the variant are renamed, while every class name is, so
+// references to missing IDs stay as they were.
+type variantPrefixer struct {
+	prefix string
+	ids    map[string]bool
+}
+
+func (p variantPrefixer) id(id string) string {
+	if p.ids[id] {
+		return p.prefix + id
+	}
+	return id
+}
+
+func (p variantPrefixer) classes(value string) string {
+	fields := strings.Fields(value)
+	for i, class := range fields {
+		fields[i] = p.prefix + class
+	}
+	return strings.Join(fields, " ")
+}
+
+// refs renames the IDs referenced through url(#id) in a value.
+func (p variantPrefixer) refs(value string) string {
+	if !strings.Contains(value, "url(") {
+		return value
+	}
+	return urlRefRe.ReplaceAllStringFunc(value, func(m string) string {
+		sub := urlRefRe.FindStringSubmatch(m)
+		return strings.TrimSuffix(m, sub[2]) + p.id(sub[2])
+	})
+}
+
+func (p variantPrefixer) attr(name, value string) string {
+	switch name {
+	case "id":
+		return p.id(value)
+	case "class":
+		return p.classes(value)
+	case "href", "xlink:href":
+		if ref, ok := strings.CutPrefix(value, "#"); ok {
+			return "#" + p.id(ref)
+		}
+		return value
+	case "aria-labelledby", "aria-describedby":
+		fields := strings.Fields(value)
+		for i, id := range fields {
+			fields[i] = p.id(id)
+		}
+		return strings.Join(fields, " ")
+	}
+	return p.refs(value)
+}
+
+// css prefixes the IDs and class names in a stylesheet and scopes its rules
+// to the elements under scope. Grouping rules such as @media are descended
+// into, while other at-rules are copied with only their references renamed.
+func (p variantPrefixer) css(css, scope string) string {
+	var b strings.Builder
+	for i := 0; i < len(css); {
+		k := indexCSSDelim(css[i:], "{};")
+		if k < 0 {
+			b.WriteString(css[i:])
+			break
+		}
+		k += i
+		if css[k] != '{' {
+			b.WriteString(css[i : k+1])
+			i = k + 1
+			continue
+		}
+
+		prelude := strings.TrimSpace(stripCSSComments(css[i:k]))
+		if rule, ok := strings.CutPrefix(prelude, "@"); ok {
+			name := strings.ToLower(rule)
+			if end := strings.IndexFunc(name, func(r rune) bool { return !isIdentByte(byte(r)) }); end >= 0 {
+				name = name[:end]
+			}
+			switch name {
+			case "media", "supports", "container", "layer":
+				b.WriteString(css[i : k+1])
+				i = k + 1
+			default:
+				end := indexBlockEnd(css[k:])
+				if end < 0 {
+					b.WriteString(css[i:])
+					return b.String()
+				}
+				b.WriteString(css[i:k] + p.refs(css[k:k+end+1]))
+				i = k + end + 1
+			}
+			continue
+		}
+
+		end := indexCSSDelim(css[k+1:], "}")
+		if end < 0 {
+			end = len(css) - k - 1
+		}
+		end += k + 1
+		b.WriteString(p.selectors(prelude, scope))
+		b.WriteString(p.refs(css[k:end]))
+		if end < len(css) {
+			b.WriteByte('}')
+		}
+		i = end + 1
+	}
+	return b.String()
+}
+
+// selectors prefixes and scopes each selector in a comma separated list.
+func (p variantPrefixer) selectors(list, scope string) string {
+	var scoped []string
+	depth, start := 0, 0
+	for i := 0; i <= len(list); i++ {
+		if i < len(list) {
+			switch list[i] {
+			case '(', '[':
+				depth++
+				continue
+			case ')', ']':
+				depth--
+				continue
+			case ',':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		selector := strings.TrimSpace(list[start:i])
+		start = i + 1
+		if selector == "" {
+			continue
+		}
+		selector = cssSelectorRe.ReplaceAllStringFunc(selector, func(m string) string {
+			if m[0] == '#' {
+				return "#" + p.id(m[1:])
+			}
+			return "." + p.prefix + m[1:]
+		})
+		scoped = append(scoped, scope+" "+selector)
+	}
+	return strings.Join(scoped, ",")
+}
+
+// indexCSSDelim returns the index of the first of delims in css that isn't
+// inside a comment or string, or -1.
+func indexCSSDelim(css, delims string) int {
+	for i := 0; i < len(css); i++ {
+		switch c := css[i]; {
+		case c == '/' && strings.HasPrefix(css[i:], "/*"):
+			end := strings.Index(css[i+2:], "*/")
+			if end < 0 {
+				return -1
+			}
+			i += end + 3
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(css[i+1:], c)
+			if end < 0 {
+				return -1
+			}
+			i += end + 1
+		case strings.IndexByte(delims, c) >= 0:
+			return i
+		}
+	}
+	return -1
+}
+
+// indexBlockEnd returns the index of the brace closing the block that css
+// opens with, or -1.
+func indexBlockEnd(css string) int {
+	depth := 0
+	for i := 0; i < len(css); {
+		k := indexCSSDelim(css[i:], "{}")
+		if k < 0 {
+			return -1
+		}
+		i += k
+		if css[i] == '{' {
+			depth++
+		} else if depth--; depth == 0 {
+			return i
+		}
+		i++
+	}
+	return -1
+}
+
+func stripCSSComments(css string) string {
+	for {
+		start := strings.Index(css, "/*")
+		if start < 0 {
+			return css
+		}
+		end := strings.Index(css[start+2:], "*/")
+		if end < 0 {
+			return css[:start]
+		}
+		css = css[:start] + css[start+2+end+2:]
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMergeAdaptiveSVG(t *testing.T) {
+	light := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><defs><linearGradient id="g"/></defs><style>.st0{fill:url(#g)}</style><path class="st0"/><use href="#g"/></svg>`
+	dark := `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 24 24"><defs><linearGradient id="g"/></defs><style>.st0{fill:#000}path{opacity:.5}</style><path class="st0" fill="url(#g)"/></svg>`
+
+	merged, err := mergeAdaptiveSVG(light, dark)
+	if err != nil {
+		t.Fatalf("mergeAdaptiveSVG: %v", err)
+	}
+	for _, want := range []string{
+		`viewBox="0 0 24 24"`,
+		`@media (prefers-color-scheme:dark)`,
+		`<svg class="adaptive-dark"`,
+		`<svg class="adaptive-light"`,
+		`id="light-g"`,
+		`id="dark-g"`,
+		`.adaptive-light .light-st0{fill:url(#light-g)}`,
+		`.adaptive-dark .dark-st0{fill:#000}`,
+		`.adaptive-dark path{opacity:.5}`,
+		`<path class="light-st0"/><use href="#light-g"/>`,
+		`<path class="dark-st0" fill="url(#dark-g)"/>`,
+	} {
+		if !strings.Contains(merged, want) {
+			t.Errorf("merged SVG is missing %s\n%s", want, merged)
+		}
+	}
+	if strings.Contains(merged, `id="g"`) || strings.Contains(merged, `"st0"`) {
+		t.Errorf("merged SVG keeps an unprefixed identifier\n%s", merged)
+	}
+}
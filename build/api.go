@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	apiDefaultPerPage = 50
+	apiMaxPerPage     = 250
+)
+
+type IconInfo struct {
+	Name       string                       `json:"name"`
+	Reference  string                       `json:"reference"`
+	Categories []string                     `json:"categories"`
+	Tags       []string                     `json:"tags"`
+	CreatedAt  string                       `json:"created_at"`
+	SVG        bool                         `json:"svg"`
+	PNG        bool                         `json:"png"`
+	WebP       bool                         `json:"webp"`
+	Light      bool                         `json:"light"`
+	Dark       bool                         `json:"dark"`
+	URLs       map[string]map[string]string `json:"urls"`
+}
+
+type IconList struct {
+	Total   int        `json:"total"`
+	Page    int        `json:"page"`
+	PerPage int        `json:"per_page"`
+	Icons   []IconInfo `json:"icons"`
+}
+
+// requestBaseURL reconstructs the URL clients used to reach the server,
+// honoring X-Forwarded-Proto from a reverse proxy.
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+	}
+	return scheme + "://" + r.Host
+}
+
+// variantURLs lists a URL for every format of the variant that exists in the
+// collection. AVIF and ICO are generated alongside every PNG.
+func variantURLs(base, name string, svg, raster bool) map[string]string {
+	urls := make(map[string]string)
+	if svg {
+		urls["svg"] = base + "/" + name + ".svg"
+	}
+	if raster {
+		for _, format := range []string{"png", "webp", "avif", "ico"} {
+			urls[format] = base + "/" + name + "." + format
+		}
+	}
+	return urls
+}
+
+func newIconInfo(e IndexEntry, base string) IconInfo {
+	urls := map[string]map[string]string{
+		"default": variantURLs(base, e.Reference, e.HasSVG(), e.HasPNG()),
+	}
+	if e.HasLight() {
+		urls["light"] = variantURLs(base, e.Reference+"-light", e.HasSVG(), true)
+	}
+	if e.HasDark() {
+		urls["dark"] = variantURLs(base, e.Reference+"-dark", e.HasSVG(), true)
+	}
+
+	return IconInfo{
+		Name:       e.Name,
+		Reference:  e.Reference,
+		Categories: e.Categories(),
+		Tags:       e.TagList(),
+		CreatedAt:  e.CreatedAt,
+		SVG:        e.HasSVG(),
+		PNG:        e.HasPNG(),
+		WebP:       e.HasWebP(),
+		Light:      e.HasLight(),
+		Dark:       e.HasDark(),
+		URLs:       urls,
+	}
+}
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func entryHasFormat(e IndexEntry, format string) bool {
+	switch format {
+	case "svg":
+		return e.HasSVG()
+	case "webp":
+		return e.HasWebP()
+	default: // png, avif and ico
+		return e.HasPNG()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func handleAPIIcons(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	entries, ok := iconIndex.Entries()
+	if !ok {
+		writeJSONError(w, http.StatusServiceUnavailable, "Icon index unavailable")
+		return
+	}
+
+	q := r.URL.Query()
+	query := strings.ToLower(strings.TrimSpace(q.Get("q")))
+	category := strings.TrimSpace(q.Get("category"))
+	tag := strings.TrimSpace(q.Get("tag"))
+	format := strings.ToLower(strings.TrimSpace(q.Get("format")))
+
+	switch format {
+	case "", "svg", "png", "webp", "avif", "ico":
+	default:
+		writeJSONError(w, http.StatusBadRequest, "Invalid format. Use svg, png, webp, avif, or ico")
+		return
+	}
+
+	page := 1
+	if v := q.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeJSONError(w, http.StatusBadRequest, "Invalid page")
+			return
+		}
+		page = n
+	}
+
+	perPage := apiDefaultPerPage
+	if v := q.Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > apiMaxPerPage {
+			writeJSONError(w, http.StatusBadRequest, "Invalid per_page. Use 1-"+strconv.Itoa(apiMaxPerPage))
+			return
+		}
+		perPage = n
+	}
+
+	var matches []IndexEntry
+	for _, e := range entries {
+		if query != "" && !strings.Contains(strings.ToLower(e.Name), query) &&
+			!strings.Contains(strings.ToLower(e.Reference), query) &&
+			!strings.Contains(strings.ToLower(e.Tags), query) {
+			continue
+		}
+		if category != "" && !containsFold(e.Categories(), category) {
+			continue
+		}
+		if tag != "" && !containsFold(e.TagList(), tag) {
+			continue
+		}
+		if format != "" && !entryHasFormat(e, format) {
+			continue
+		}
+		matches = append(matches, e)
+	}
+
+	base := requestBaseURL(r)
+	list := IconList{Total: len(matches), Page: page, PerPage: perPage, Icons: []IconInfo{}}
+	// Pages past the end are empty; checking first keeps the offset from overflowing
+	if page-1 <= len(matches)/perPage {
+		offset := (page - 1) * perPage
+		for _, e := range matches[offset:min(offset+perPage, len(matches))] {
+			list.Icons = append(list.Icons, newIconInfo(e, base))
+		}
+	}
+
+	logf(logLevelDebug, "[API] Icon search q=\"%s\" category=\"%s\" tag=\"%s\" format=\"%s\": %d results %v", query, category, tag, format, len(matches), formatDuration(time.Since(start)))
+	writeJSON(w, http.StatusOK, list)
+}
+
+func handleAPIIcon(w http.ResponseWriter, r *http.Request) {
+	reference := r.PathValue("reference")
+
+	if _, ok := iconIndex.Entries(); !ok {
+		writeJSONError(w, http.StatusServiceUnavailable, "Icon index unavailable")
+		return
+	}
+
+	entry, found := iconIndex.Lookup(reference)
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "Icon not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newIconInfo(entry, requestBaseURL(r)))
+}
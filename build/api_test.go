@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleAPIIconsPagination(t *testing.T) {
+	savedConfig, savedIndex := config, iconIndex
+	defer func() { config, iconIndex = savedConfig, savedIndex }()
+	config = &Config{LogLevel: logLevelError}
+	iconIndex = &IconIndex{entries: []IndexEntry{
+		{Name: "Alpha", Reference: "alpha", SVG: "Yes"},
+		{Name: "Beta", Reference: "beta", SVG: "Yes"},
+		{Name: "Gamma", Reference: "gamma", SVG: "Yes"},
+	}}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"page=1&per_page=2", []string{"alpha", "beta"}},
+		{"page=2&per_page=2", []string{"gamma"}},
+		{"page=3&per_page=2", nil},
+		{"page=4611686018427387904&per_page=4", nil},
+		{"page=9223372036854775807&per_page=100", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handleAPIIcons(rec, httptest.NewRequest(http.MethodGet, "/api/icons?"+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+			}
+			var list IconList
+			if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if list.Total != 3 || len(list.Icons) != len(tt.want) {
+				t.Fatalf("got total %d and %d icons, want 3 and %d", list.Total, len(list.Icons), len(tt.want))
+			}
+			for i, icon := range list.Icons {
+				if icon.Reference != tt.want[i] {
+					t.Errorf("icon %d is %s, want %s", i, icon.Reference, tt.want[i])
+				}
+			}
+		})
+	}
+}
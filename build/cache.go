@@ -0,0 +1,181 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// CacheItem is a cached response. Remote icons also record the upstream path
+// and validators they were built from so an expired item can be revalidated,
+// and may carry their own TTL taken from the upstream max-age.
+type CacheItem struct {
+	Content      string
+	ContentType  string
+	Timestamp    time.Time
+	TTL          time.Duration
+	Origin       string
+	ETag         string
+	LastModified string
+}
+
+type cacheEntry struct {
+	key  string
+	item CacheItem
+	size int64
+}
+
+type cacheState int
+
+const (
+	cacheMiss cacheState = iota
+	cacheFresh
+	cacheStale
+)
+
+// Cache is an LRU cache bounded by both item count and total bytes. Every
+// operation is O(1): entries live in a list ordered by recency, with the map
+// pointing into it. Expired entries are kept for a further grace period so
+// they can be served stale while being refreshed.
+type Cache struct {
+	items    map[string]*list.Element
+	order    *list.List // front is most recently used
+	mutex    sync.Mutex
+	ttl      time.Duration
+	grace    time.Duration
+	max      int
+	maxBytes int64
+	bytes    int64
+}
+
+func NewCache(ttl, grace time.Duration, maxSize int, maxBytes int64) *Cache {
+	return &Cache{
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+		ttl:      ttl,
+		grace:    grace,
+		max:      maxSize,
+		maxBytes: maxBytes,
+	}
+}
+
+func entrySize(key string, item CacheItem) int64 {
+	return int64(len(key) + len(item.Content) + len(item.ContentType))
+}
+
+// Get returns an item only while it is fresh.
+func (c *Cache) Get(key string) (CacheItem, bool) {
+	item, state := c.Lookup(key)
+	return item, state == cacheFresh
+}
+
+// Lookup returns an item along with whether it is fresh or expired but still
+// within the grace period.
+func (c *Cache) Lookup(key string) (CacheItem, cacheState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, exists := c.items[key]
+	if !exists {
+		return CacheItem{}, cacheMiss
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	age := time.Since(entry.item.Timestamp)
+	ttl := c.itemTTL(entry.item)
+	if age > ttl+c.grace {
+		c.remove(elem)
+		return CacheItem{}, cacheMiss
+	}
+
+	c.order.MoveToFront(elem)
+	if age > ttl {
+		return entry.item, cacheStale
+	}
+	return entry.item, cacheFresh
+}
+
+func (c *Cache) cleanup() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for elem := c.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		item := elem.Value.(*cacheEntry).item
+		if time.Since(item.Timestamp) > c.itemTTL(item)+c.grace {
+			c.remove(elem)
+		}
+		elem = prev
+	}
+}
+
+func (c *Cache) itemTTL(item CacheItem) time.Duration {
+	if item.TTL > 0 {
+		return item.TTL
+	}
+	return c.ttl
+}
+
+func (c *Cache) Set(key, content, contentType string) {
+	c.SetItem(key, CacheItem{Content: content, ContentType: contentType})
+}
+
+// SetItem stores an item, stamping it with the current time.
+func (c *Cache) SetItem(key string, item CacheItem) {
+	item.Timestamp = time.Now()
+	size := entrySize(key, item)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, exists := c.items[key]; exists {
+		c.remove(elem)
+	}
+
+	// An item that can never fit would only flush everything else
+	if size > c.maxBytes {
+		return
+	}
+
+	for c.order.Len() > 0 && (c.order.Len() >= c.max || c.bytes+size > c.maxBytes) {
+		c.remove(c.order.Back())
+	}
+
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, item: item, size: size})
+	c.bytes += size
+}
+
+// Touch marks an item as fresh again, as after a successful revalidation. A
+// non-zero ttl replaces the item's own TTL.
+func (c *Cache) Touch(key string, ttl time.Duration) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, exists := c.items[key]
+	if !exists {
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	entry.item.Timestamp = time.Now()
+	if ttl > 0 {
+		entry.item.TTL = ttl
+	}
+	c.order.MoveToFront(elem)
+	return true
+}
+
+// Clear drops every item and returns how many there were.
+func (c *Cache) Clear() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := c.order.Len()
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+	c.bytes = 0
+	return n
+}
+
+func (c *Cache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*cacheEntry)
+	delete(c.items, entry.key)
+	c.bytes -= entry.size
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const diskCacheExt = ".cache"
+
+// diskMeta is stored as the first line of each cache file, followed by the body.
+type diskMeta struct {
+	Key          string    `json:"key"`
+	ContentType  string    `json:"content_type"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	StoredAt     time.Time `json:"stored_at"`
+}
+
+type diskEntry struct {
+	name     string
+	size     int64
+	storedAt time.Time
+}
+
+// DiskCache is a persistent second tier for remote fetches, keyed by path
+// within the collection so it survives restarts and mirror changes. Entries
+// past the TTL are kept for a further retain period so they can be
+// revalidated upstream, and are evicted oldest-first after that or once the
+// directory grows past maxBytes.
+type DiskCache struct {
+	dir      string
+	ttl      time.Duration
+	retain   time.Duration
+	maxBytes int64
+	entries  map[string]*list.Element
+	order    *list.List // front is oldest
+	bytes    int64
+	mutex    sync.Mutex
+}
+
+func NewDiskCache(dir string, ttl, retain time.Duration, maxBytes int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []diskEntry
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		// Leftovers from writes interrupted by a crash or restart
+		if strings.HasPrefix(f.Name(), ".tmp-") {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), diskCacheExt) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, diskEntry{name: f.Name(), size: info.Size(), storedAt: info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].storedAt.Before(found[j].storedAt) })
+
+	d := &DiskCache{
+		dir:      dir,
+		ttl:      ttl,
+		retain:   retain,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+	for i := range found {
+		d.entries[found[i].name] = d.order.PushBack(&found[i])
+		d.bytes += found[i].size
+	}
+	d.cleanup()
+	return d, nil
+}
+
+func diskCacheName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + diskCacheExt
+}
+
+// Get returns the stored object for key and whether it is still within the TTL.
+func (d *DiskCache) Get(key string) (obj RemoteObject, fresh bool, found bool) {
+	name := diskCacheName(key)
+
+	d.mutex.Lock()
+	elem, exists := d.entries[name]
+	if exists {
+		age := time.Since(elem.Value.(*diskEntry).storedAt)
+		if age > d.ttl+d.retain {
+			d.remove(elem)
+			exists = false
+		}
+		fresh = age <= d.ttl
+	}
+	d.mutex.Unlock()
+	if !exists {
+		return RemoteObject{}, false, false
+	}
+
+	data, err := os.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		return RemoteObject{}, false, false
+	}
+	header, body, ok := bytes.Cut(data, []byte("\n"))
+	if !ok {
+		return RemoteObject{}, false, false
+	}
+	var meta diskMeta
+	if err := json.Unmarshal(header, &meta); err != nil || meta.Key != key {
+		return RemoteObject{}, false, false
+	}
+
+	obj = RemoteObject{
+		Content:      string(body),
+		ContentType:  meta.ContentType,
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+	}
+	return obj, fresh, true
+}
+
+func (d *DiskCache) Set(key string, obj RemoteObject) {
+	header, err := json.Marshal(diskMeta{
+		Key:          key,
+		ContentType:  obj.ContentType,
+		ETag:         obj.ETag,
+		LastModified: obj.LastModified,
+		StoredAt:     time.Now(),
+	})
+	if err != nil {
+		return
+	}
+	size := int64(len(header) + 1 + len(obj.Content))
+	if size > d.maxBytes {
+		return
+	}
+
+	name := diskCacheName(key)
+	if err := writeFileAtomic(d.dir, name, append(append(header, '\n'), obj.Content...)); err != nil {
+		logf(logLevelError, "[ERROR] Failed to write disk cache entry for %s: %v", key, err)
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if elem, exists := d.entries[name]; exists {
+		// The file was already replaced by the rename, only drop the accounting
+		entry := d.order.Remove(elem).(*diskEntry)
+		d.bytes -= entry.size
+		delete(d.entries, name)
+	}
+	d.entries[name] = d.order.PushBack(&diskEntry{name: name, size: size, storedAt: time.Now()})
+	d.bytes += size
+	for d.bytes > d.maxBytes && d.order.Len() > 1 {
+		d.remove(d.order.Front())
+	}
+}
+
+func (d *DiskCache) cleanup() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for elem := d.order.Front(); elem != nil; elem = d.order.Front() {
+		entry := elem.Value.(*diskEntry)
+		if time.Since(entry.storedAt) <= d.ttl+d.retain && d.bytes <= d.maxBytes {
+			break
+		}
+		d.remove(elem)
+	}
+}
+
+func (d *DiskCache) remove(elem *list.Element) {
+	entry := d.order.Remove(elem).(*diskEntry)
+	delete(d.entries, entry.name)
+	d.bytes -= entry.size
+	os.Remove(filepath.Join(d.dir, entry.name))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var errFlightAborted = errors.New("request aborted")
+
+type flightCall[T any] struct {
+	done    chan struct{}
+	val     T
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// flightGroup deduplicates concurrent work by key: the first caller starts fn
+// and every caller that arrives while it is in flight waits for and shares its
+// result, including the error. fn runs with its own context, which is only
+// canceled once every waiting caller has given up; callers arriving after that
+// start a new flight.
+type flightGroup[T any] struct {
+	calls map[string]*flightCall[T]
+	mutex sync.Mutex
+}
+
+// Do runs fn for key unless a call is already in flight, in which case it
+// waits for that call instead. shared reports whether the result came from
+// another caller. If ctx is done first, Do returns its error without waiting.
+func (g *flightGroup[T]) Do(ctx context.Context, key string, fn func(context.Context) (T, error)) (val T, err error, shared bool) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	c, exists := g.calls[key]
+	if exists {
+		c.waiters++
+	} else {
+		// Waiters see errFlightAborted if fn panics before producing a result
+		c = &flightCall[T]{done: make(chan struct{}), err: errFlightAborted, waiters: 1}
+		var flightCtx context.Context
+		flightCtx, c.cancel = context.WithCancel(context.WithoutCancel(ctx))
+		g.calls[key] = c
+		go g.run(flightCtx, key, c, fn)
+	}
+	g.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err, exists
+	case <-ctx.Done():
+		g.mutex.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// Later callers must not join a canceled flight
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			c.cancel()
+		}
+		g.mutex.Unlock()
+		var zero T
+		return zero, ctx.Err(), exists
+	}
+}
+
+func (g *flightGroup[T]) run(ctx context.Context, key string, c *flightCall[T], fn func(context.Context) (T, error)) {
+	defer func() {
+		if p := recover(); p != nil {
+			logf(logLevelError, "[ERROR] Panic while loading \"%s\": %v", key, p)
+		}
+		g.mutex.Lock()
+		if g.calls[key] == c {
+			delete(g.calls, key)
+		}
+		g.mutex.Unlock()
+		c.cancel()
+		close(c.done)
+	}()
+
+	c.val, c.err = fn(ctx)
+}
@@ -1,3 +1,16 @@
 module github.com/selfhst/icons
 
-go 1.26.3
\ No newline at end of file
+go 1.26.3
+
+require (
+	github.com/HugoSmits86/nativewebp v0.9.3
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20220730225603-2ab79fcdd4ef
+	golang.org/x/image v0.46.0
+)
+
+require (
+	golang.org/x/net v0.60.0 // indirect
+	golang.org/x/sys v0.48.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+)
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexRetryInterval limits how often a failed index load is retried on demand.
+const indexRetryInterval = time.Minute
+
+// IndexEntry mirrors an entry in the collection's index.json.
+type IndexEntry struct {
+	Name      string
+	Reference string
+	SVG       string
+	PNG       string
+	WebP      string
+	Light     string
+	Dark      string
+	Category  string
+	Tags      string
+	CreatedAt string
+}
+
+func (e IndexEntry) HasSVG() bool   { return e.SVG == "Yes" }
+func (e IndexEntry) HasPNG() bool   { return e.PNG == "Yes" }
+func (e IndexEntry) HasWebP() bool  { return e.WebP == "Yes" }
+func (e IndexEntry) HasLight() bool { return e.Light == "Yes" }
+func (e IndexEntry) HasDark() bool  { return e.Dark == "Yes" }
+
+func (e IndexEntry) Categories() []string { return splitList(e.Category) }
+func (e IndexEntry) TagList() []string    { return splitList(e.Tags) }
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if trimmed := strings.TrimSpace(v); trimmed != "" {
+			list = append(list, trimmed)
+		}
+	}
+	return list
+}
+
+// IconIndex is the parsed index.json of the collection. remoteOnly indexes
+// always load from the mirrors and record the validators of the last download
+// so Refresh can tell whether it changed.
+type IconIndex struct {
+	entries      []IndexEntry
+	byRef        map[string]int
+	byNormalized map[string]int
+	aliases      map[string]string
+	source       string
+	remoteOnly   bool
+	etag         string
+	lastModified string
+	lastAttempt  time.Time
+	loading      bool
+	mutex        sync.RWMutex
+}
+
+// iconIndex describes the configured collection, preferring the local volume
+// in hybrid mode. remoteIndex describes what the mirrors serve and is the
+// same index in remote mode.
+var (
+	iconIndex   = &IconIndex{}
+	remoteIndex *IconIndex
+)
+
+// readCollectionFile loads a metadata file from the root of the collection,
+// preferring the local volume in hybrid mode unless remoteOnly is set.
+func readCollectionFile(ctx context.Context, name string, remoteOnly bool) (string, string, error) {
+	var errs []string
+	if !remoteOnly && (config.IconSource == "local" || config.IconSource == "hybrid") {
+		content, err := readLocalFile(filepath.Join(config.LocalPath, name))
+		if err == nil {
+			return content, "local", nil
+		}
+		errs = append(errs, "local: "+err.Error())
+	}
+	if config.IconSource == "remote" || config.IconSource == "hybrid" {
+		content, err := fetchRemoteFile(ctx, name)
+		if err == nil {
+			return content, "remote", nil
+		}
+		errs = append(errs, "remote: "+err.Error())
+	}
+	return "", "", fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+func (idx *IconIndex) Load(ctx context.Context) error {
+	idx.mutex.Lock()
+	idx.lastAttempt = time.Now()
+	idx.mutex.Unlock()
+
+	content, source, err := readCollectionFile(ctx, "index.json", idx.remoteOnly)
+	if err != nil {
+		return err
+	}
+	return idx.apply(ctx, content, source, "", "")
+}
+
+// Refresh reloads a remote index if it changed upstream. The request is
+// conditional on the last download, so an unchanged index costs a 304.
+func (idx *IconIndex) Refresh(ctx context.Context) error {
+	idx.mutex.RLock()
+	etag, lastModified := idx.etag, idx.lastModified
+	idx.mutex.RUnlock()
+
+	obj, err := mirrors.request(ctx, "index.json", etag, lastModified)
+	if err != nil {
+		return err
+	}
+	if obj.NotModified {
+		logf(logLevelDebug, "[RESOLVE] Remote index unchanged (%s)", obj.Mirror)
+		return nil
+	}
+	if err := idx.apply(ctx, obj.Content, "remote", obj.ETag, obj.LastModified); err != nil {
+		return err
+	}
+	if diskCache != nil {
+		diskCache.Set("index.json", obj)
+	}
+	entries, _ := idx.Entries()
+	logf(logLevelInfo, "[RESOLVE] Remote index refreshed: %d icons (%s)", len(entries), obj.Mirror)
+	return nil
+}
+
+// refreshLoop keeps a remote index up to date until ctx is canceled.
+func (idx *IconIndex) refreshLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := idx.Refresh(ctx); err != nil {
+				logf(logLevelError, "[WARN] Failed to refresh remote icon index, keeping current one: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (idx *IconIndex) apply(ctx context.Context, content, source, etag, lastModified string) error {
+	var entries []IndexEntry
+	if err := json.Unmarshal([]byte(content), &entries); err != nil {
+		return fmt.Errorf("invalid index.json: %v", err)
+	}
+
+	byRef := make(map[string]int, len(entries))
+	byNormalized := make(map[string]int, len(entries)*2)
+	for i, e := range entries {
+		byRef[strings.ToLower(e.Reference)] = i
+		for _, key := range []string{normalizeName(e.Reference), normalizeName(e.Name)} {
+			if prev, exists := byNormalized[key]; exists && prev != i {
+				byNormalized[key] = -1 // ambiguous, never resolve
+			} else {
+				byNormalized[key] = i
+			}
+		}
+	}
+
+	// aliases.json is optional: a missing file just means nothing was renamed
+	aliases := make(map[string]string)
+	if content, _, err := readCollectionFile(ctx, "aliases.json", idx.remoteOnly); err == nil {
+		var raw map[string]string
+		if err := json.Unmarshal([]byte(content), &raw); err != nil {
+			logf(logLevelError, "[WARN] Ignoring invalid aliases.json: %v", err)
+		}
+		for from, to := range raw {
+			if strings.Contains(to, "..") || strings.ContainsAny(to, "/\\") {
+				logf(logLevelError, "[WARN] Ignoring invalid alias \"%s\" -> \"%s\"", from, to)
+				continue
+			}
+			aliases[strings.ToLower(from)] = strings.ToLower(to)
+		}
+	} else {
+		logf(logLevelDebug, "[WARN] No aliases.json available: %v", err)
+	}
+
+	idx.mutex.Lock()
+	idx.entries = entries
+	idx.byRef = byRef
+	idx.byNormalized = byNormalized
+	idx.aliases = aliases
+	idx.source = source
+	idx.etag = etag
+	idx.lastModified = lastModified
+	idx.mutex.Unlock()
+	return nil
+}
+
+// Entries returns the loaded index. A failed load is retried in the
+// background, at most once per indexRetryInterval so a missing index doesn't
+// hammer the source, and never holds up the caller.
+func (idx *IconIndex) Entries() ([]IndexEntry, bool) {
+	idx.mutex.Lock()
+	entries := idx.entries
+	retry := entries == nil && !idx.loading && time.Since(idx.lastAttempt) > indexRetryInterval
+	if retry {
+		idx.loading = true
+		idx.lastAttempt = time.Now()
+	}
+	idx.mutex.Unlock()
+
+	if retry {
+		go idx.reload()
+	}
+	return entries, entries != nil
+}
+
+func (idx *IconIndex) reload() {
+	defer func() {
+		idx.mutex.Lock()
+		idx.loading = false
+		idx.mutex.Unlock()
+	}()
+	if err := idx.Load(shutdownCtx); err != nil {
+		logf(logLevelError, "[ERROR] Failed to load icon index: %v", err)
+		return
+	}
+	entries, _ := idx.Entries()
+	logf(logLevelInfo, "[RESOLVE] Icon index loaded: %d icons", len(entries))
+}
+
+func (idx *IconIndex) Lookup(reference string) (IndexEntry, bool) {
+	if _, ok := idx.Entries(); !ok {
+		return IndexEntry{}, false
+	}
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+	i, found := idx.byRef[strings.ToLower(reference)]
+	if !found {
+		return IndexEntry{}, false
+	}
+	return idx.entries[i], true
+}
+
+// HasFile reports whether the index lists a file for an icon name, which may
+// carry a -light or -dark suffix, in the given format. known is false while
+// the index is unavailable or doesn't have an entry for the icon, since the
+// collection holds some files index.json doesn't list; those have to be tried.
+func (idx *IconIndex) HasFile(name, format string) (exists, known bool) {
+	if _, ok := idx.Entries(); !ok {
+		return false, false
+	}
+	if entry, found := idx.Lookup(name); found {
+		return entryHasFormat(entry, format), true
+	}
+	for _, suffix := range variantSuffixes {
+		base, isVariant := strings.CutSuffix(name, suffix)
+		if !isVariant {
+			continue
+		}
+		entry, found := idx.Lookup(base)
+		if !found {
+			return false, false
+		}
+		if (suffix == "-light" && !entry.HasLight()) || (suffix == "-dark" && !entry.HasDark()) {
+			return false, true
+		}
+		// Variants come in every raster format, and as SVG when the icon has one
+		return format != "svg" || entry.HasSVG(), true
+	}
+	return false, false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errQueueFull is returned when every upstream slot is taken and the wait
+// queue is full as well.
+var errQueueFull = errors.New("too many upstream requests queued")
+
+// queueRetryAfter is the Retry-After, in seconds, sent when the queue is full.
+const queueRetryAfter = 2
+
+// fetchLimiter caps the number of concurrent upstream requests. Callers past
+// the cap wait in a bounded queue, and are turned away once that fills up.
+type fetchLimiter struct {
+	slots    chan struct{}
+	maxQueue int
+	queued   int
+	mutex    sync.Mutex
+}
+
+var upstreamLimiter *fetchLimiter
+
+func newFetchLimiter(maxConcurrent, maxQueue int) *fetchLimiter {
+	return &fetchLimiter{slots: make(chan struct{}, maxConcurrent), maxQueue: maxQueue}
+}
+
+// acquire takes a slot, waiting in the queue if there is room. The returned
+// function releases the slot.
+func (l *fetchLimiter) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	l.mutex.Lock()
+	if l.queued >= l.maxQueue {
+		l.mutex.Unlock()
+		return nil, errQueueFull
+	}
+	l.queued++
+	l.mutex.Unlock()
+
+	defer func() {
+		l.mutex.Lock()
+		l.queued--
+		l.mutex.Unlock()
+	}()
+
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// stats returns the number of requests in flight and waiting.
+func (l *fetchLimiter) stats() (active, queued int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.slots), l.queued
+}
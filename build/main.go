@@ -3,18 +3,23 @@ package main
 import (
 	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 )
@@ -26,111 +31,54 @@ const (
 )
 
 type Config struct {
-	Port          string
-	IconSource    string
-	RemoteURL     string
-	LocalPath     string
-	PrimaryColor  string
-	CacheTTL      time.Duration
-	CacheSize     int
-	RemoteTimeout time.Duration
-	CORSOrigins   []string
-	LogLevel      int
-}
-
-type CacheItem struct {
-	Content     string
-	ContentType string
-	Timestamp   time.Time
-}
-
-type Cache struct {
-	items map[string]CacheItem
-	mutex sync.RWMutex
-	ttl   time.Duration
-	max   int
-}
-
-func NewCache(ttl time.Duration, maxSize int) *Cache {
-	return &Cache{
-		items: make(map[string]CacheItem),
-		ttl:   ttl,
-		max:   maxSize,
-	}
-}
-
-func (c *Cache) Get(key string) (CacheItem, bool) {
-	c.mutex.RLock()
-	item, exists := c.items[key]
-	c.mutex.RUnlock()
-
-	if !exists {
-		return CacheItem{}, false
-	}
-
-	if time.Since(item.Timestamp) > c.ttl {
-		c.mutex.Lock()
-		if current, exists := c.items[key]; exists && time.Since(current.Timestamp) > c.ttl {
-			delete(c.items, key)
-		}
-		c.mutex.Unlock()
-		return CacheItem{}, false
-	}
-
-	return item, true
-}
-
-func (c *Cache) cleanup() {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-	for k, v := range c.items {
-		if time.Since(v.Timestamp) > c.ttl {
-			delete(c.items, k)
-		}
-	}
-}
-
-func (c *Cache) Set(key, content, contentType string) {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
-
-	if len(c.items) >= c.max {
-		var oldestKey string
-		var oldestTime time.Time
-		first := true
-
-		for k, v := range c.items {
-			if first || v.Timestamp.Before(oldestTime) {
-				oldestKey = k
-				oldestTime = v.Timestamp
-				first = false
-			}
-		}
-		delete(c.items, oldestKey)
-	}
-
-	c.items[key] = CacheItem{
-		Content:     content,
-		ContentType: contentType,
-		Timestamp:   time.Now(),
-	}
+	Port              string
+	IconSource        string
+	RemoteURLs        []string
+	MirrorMaxFailures int
+	MirrorCooldown    time.Duration
+	LocalPath         string
+	PrimaryColor      string
+	CacheTTL          time.Duration
+	CacheStaleTTL     time.Duration
+	CacheSize         int
+	CacheMaxBytes     int64
+	CacheNotFoundTTL  time.Duration
+	CacheNotFoundSize int
+	CacheNotFoundMax  int64
+	CacheDir          string
+	DiskCacheTTL      time.Duration
+	DiskCacheMax      int64
+	UseUpstreamMaxAge bool
+	RemoteTimeout     time.Duration
+	RemoteDeadline    time.Duration
+	RemoteRetries     int
+	RemoteMaxBytes    int64
+	IndexRefresh      time.Duration
+	LocalWriteThrough bool
+	LocalWriteMax     int64
+	RemoteConcurrency int
+	RemoteQueueSize   int
+	CORSOrigins       []string
+	LogLevel          int
+	AllowedSizes      []int
 }
 
 var (
 	config     *Config
 	cache      *Cache
+	missCache  *Cache
+	diskCache  *DiskCache
 	httpClient *http.Client
 )
 
-// whiteVal matches any way an SVG can express white as a color value:
-// 3/4/6/7/8-digit hex, the "white" keyword, or rgb()/rgba() of 255,255,255.
-const whiteVal = `#fff(?:[0-9a-fA-F]|fff[0-9a-fA-F]{0,2})?|white|rgba?\(\s*255\s*[,\s]\s*255\s*[,\s]\s*255\s*(?:[,/]\s*[0-9.]+%?\s*)?\)`
+// shutdownCtx is the base of every request context and is canceled as soon as
+// the server starts shutting down, stopping in-flight upstream requests.
+var shutdownCtx, cancelShutdown = context.WithCancel(context.Background())
 
-var (
-	hexColorRe  = regexp.MustCompile(`^[0-9A-Fa-f]{6}$`)
-	reColorProp = regexp.MustCompile(`(?i)(fill|stop-color):(\s*)(` + whiteVal + `)([\s;}/),"']|$)`)
-	reColorAttr = regexp.MustCompile(`(?i)(fill|stop-color)=(["'])(` + whiteVal + `)(["'])`)
-)
+// serverWriteTimeout bounds the time to answer a request.
+const serverWriteTimeout = 30 * time.Second
+
+var hexColorRe = regexp.MustCompile(`^[0-9A-Fa-f]{6}$`)
 
 func logf(level int, format string, args ...any) {
 	if level >= config.LogLevel {
@@ -163,6 +111,69 @@ func parseIntEnv(name string, def int) int {
 	return def
 }
 
+func parseBoolEnv(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	if b, err := strconv.ParseBool(v); err == nil {
+		return b
+	}
+	log.Printf("[WARN] Invalid %s value \"%s\", using default (%t)", name, v, def)
+	return def
+}
+
+// parseNonNegativeIntEnv is parseIntEnv for settings where 0 disables a feature.
+func parseNonNegativeIntEnv(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return n
+	}
+	log.Printf("[WARN] Invalid %s value \"%s\", using default (%d)", name, v, def)
+	return def
+}
+
+// parseByteSizeEnv reads a byte count, accepting an optional KB/MB/GB suffix
+// (powers of 1024) for convenience.
+func parseByteSizeEnv(name string, def int64) int64 {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	s := strings.ToUpper(strings.TrimSpace(v))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.size
+			break
+		}
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		return n * multiplier
+	}
+	log.Printf("[WARN] Invalid %s value \"%s\", using default (%s)", name, v, formatBytes(def))
+	return def
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dGB", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKB", n>>10)
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
+
 func loadConfig() *Config {
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -178,12 +189,37 @@ func loadConfig() *Config {
 	if remoteURL == "" {
 		remoteURL = "https://cdn.jsdelivr.net/gh/selfhst/icons@main"
 	}
+	var remoteURLs []string
+	for _, u := range strings.Split(remoteURL, ",") {
+		if trimmed := strings.TrimRight(strings.TrimSpace(u), "/"); trimmed != "" {
+			remoteURLs = append(remoteURLs, trimmed)
+		}
+	}
+	mirrorMaxFailures := parseIntEnv("MIRROR_MAX_FAILURES", 3)
+	mirrorCooldown := time.Duration(parseIntEnv("MIRROR_COOLDOWN", 60)) * time.Second
 
 	primaryColor := strings.TrimPrefix(os.Getenv("PRIMARY_COLOR"), "#")
 
 	cacheTTL := time.Duration(parseIntEnv("CACHE_TTL", 3600)) * time.Second
+	cacheStaleTTL := time.Duration(parseNonNegativeIntEnv("CACHE_STALE_TTL", 86400)) * time.Second
 	cacheSize := parseIntEnv("CACHE_SIZE", 500)
+	cacheMaxBytes := parseByteSizeEnv("CACHE_MAX_BYTES", 64<<20)
+	cacheNotFoundTTL := time.Duration(parseNonNegativeIntEnv("CACHE_NOT_FOUND_TTL", 60)) * time.Second
+	cacheNotFoundSize := parseIntEnv("CACHE_NOT_FOUND_SIZE", 1000)
+	cacheNotFoundMax := parseByteSizeEnv("CACHE_NOT_FOUND_MAX_BYTES", 2<<20)
+	cacheDir := os.Getenv("CACHE_DIR")
+	diskCacheTTL := time.Duration(parseIntEnv("CACHE_DIR_TTL", 604800)) * time.Second
+	diskCacheMax := parseByteSizeEnv("CACHE_DIR_MAX_BYTES", 512<<20)
+	useUpstreamMaxAge := parseBoolEnv("USE_UPSTREAM_MAX_AGE", false)
 	remoteTimeout := time.Duration(parseIntEnv("REMOTE_TIMEOUT", 10)) * time.Second
+	remoteDeadline := time.Duration(parseIntEnv("REMOTE_DEADLINE", 20)) * time.Second
+	remoteRetries := parseNonNegativeIntEnv("REMOTE_RETRIES", 2)
+	remoteMaxBytes := parseByteSizeEnv("REMOTE_MAX_BYTES", 10<<20)
+	indexRefresh := time.Duration(parseIntEnv("INDEX_REFRESH_INTERVAL", 3600)) * time.Second
+	localWriteThrough := parseBoolEnv("LOCAL_WRITE_THROUGH", false)
+	localWriteMax := parseByteSizeEnv("LOCAL_WRITE_MAX_BYTES", 1<<30)
+	remoteConcurrency := parseIntEnv("REMOTE_MAX_CONCURRENT", 16)
+	remoteQueueSize := parseNonNegativeIntEnv("REMOTE_QUEUE_SIZE", 256)
 
 	corsAllowedOrigins := os.Getenv("CORS_ALLOWED_ORIGINS")
 	if corsAllowedOrigins == "" {
@@ -196,6 +232,24 @@ func loadConfig() *Config {
 		}
 	}
 
+	allowedSizesEnv := os.Getenv("ALLOWED_SIZES")
+	if allowedSizesEnv == "" {
+		allowedSizesEnv = "16,24,32,48,64,96,128,180,192,256,512"
+	}
+	var allowedSizes []int
+	for _, v := range strings.Split(allowedSizesEnv, ",") {
+		trimmed := strings.TrimSpace(v)
+		if trimmed == "" {
+			continue
+		}
+		n, err := strconv.Atoi(trimmed)
+		if err != nil || n < minResizeSize || n > maxResizeSize {
+			log.Printf("[WARN] Invalid ALLOWED_SIZES entry \"%s\" (must be %d-%d), ignoring", trimmed, minResizeSize, maxResizeSize)
+			continue
+		}
+		allowedSizes = append(allowedSizes, n)
+	}
+
 	logLevel := logLevelInfo
 	if v := os.Getenv("LOG_LEVEL"); v != "" {
 		switch strings.ToLower(v) {
@@ -211,16 +265,36 @@ func loadConfig() *Config {
 	}
 
 	return &Config{
-		Port:          port,
-		IconSource:    iconSource,
-		RemoteURL:     remoteURL,
-		LocalPath:     "/app/icons",
-		PrimaryColor:  primaryColor,
-		CacheTTL:      cacheTTL,
-		CacheSize:     cacheSize,
-		RemoteTimeout: remoteTimeout,
-		CORSOrigins:   corsOrigins,
-		LogLevel:      logLevel,
+		Port:              port,
+		IconSource:        iconSource,
+		RemoteURLs:        remoteURLs,
+		MirrorMaxFailures: mirrorMaxFailures,
+		MirrorCooldown:    mirrorCooldown,
+		LocalPath:         "/app/icons",
+		PrimaryColor:      primaryColor,
+		CacheTTL:          cacheTTL,
+		CacheStaleTTL:     cacheStaleTTL,
+		CacheSize:         cacheSize,
+		CacheMaxBytes:     cacheMaxBytes,
+		CacheNotFoundTTL:  cacheNotFoundTTL,
+		CacheNotFoundSize: cacheNotFoundSize,
+		CacheNotFoundMax:  cacheNotFoundMax,
+		CacheDir:          cacheDir,
+		DiskCacheTTL:      diskCacheTTL,
+		DiskCacheMax:      diskCacheMax,
+		UseUpstreamMaxAge: useUpstreamMaxAge,
+		RemoteTimeout:     remoteTimeout,
+		RemoteDeadline:    remoteDeadline,
+		RemoteRetries:     remoteRetries,
+		RemoteMaxBytes:    remoteMaxBytes,
+		IndexRefresh:      indexRefresh,
+		LocalWriteThrough: localWriteThrough,
+		LocalWriteMax:     localWriteMax,
+		RemoteConcurrency: remoteConcurrency,
+		RemoteQueueSize:   remoteQueueSize,
+		CORSOrigins:       corsOrigins,
+		LogLevel:          logLevel,
+		AllowedSizes:      allowedSizes,
 	}
 }
 
@@ -255,9 +329,31 @@ func validateConfig(cfg *Config) {
 			log.Fatalf("[ERROR] Icon path \"%s\" is not a directory", cfg.LocalPath)
 		}
 	}
+	if cfg.IconSource != "local" {
+		if len(cfg.RemoteURLs) == 0 {
+			log.Fatalf("[ERROR] REMOTE_URL does not contain any mirrors")
+		}
+		for _, u := range cfg.RemoteURLs {
+			if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+				log.Fatalf("[ERROR] REMOTE_URL entry \"%s\" must start with http:// or https://", u)
+			}
+			if err := validateTemplate(u); err != nil {
+				log.Fatalf("[ERROR] REMOTE_URL entry \"%s\" is not a valid template: %v", u, err)
+			}
+		}
+		if cfg.RemoteDeadline >= serverWriteTimeout {
+			log.Printf("[WARN] REMOTE_DEADLINE of %ds is not below the %ds response timeout, slow upstreams will drop connections", int(cfg.RemoteDeadline.Seconds()), int(serverWriteTimeout.Seconds()))
+		}
+	}
 	if cfg.PrimaryColor != "" && !isValidHexColor(cfg.PrimaryColor) {
 		log.Fatalf("[ERROR] PRIMARY_COLOR \"%s\" is not a valid 6-digit hex color", cfg.PrimaryColor)
 	}
+	if cfg.LocalWriteThrough && cfg.IconSource != "hybrid" {
+		log.Printf("[WARN] LOCAL_WRITE_THROUGH only applies to ICON_SOURCE \"hybrid\" and has no effect")
+	}
+	if cfg.CacheDir != "" && cfg.IconSource == "local" {
+		log.Printf("[WARN] CACHE_DIR is only used for remote icons and has no effect with ICON_SOURCE \"local\"")
+	}
 	for _, origin := range cfg.CORSOrigins {
 		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
 			log.Printf("[WARN] CORS_ALLOWED_ORIGINS entry \"%s\" is missing a scheme — did you mean \"https://%s\"?", origin, origin)
@@ -269,6 +365,37 @@ func isValidHexColor(color string) bool {
 	return hexColorRe.MatchString(color)
 }
 
+// isSizeSegment reports whether a path segment looks like a pixel size rather
+// than a color code, letting /{iconname}/{size} share a route with colors.
+func isSizeSegment(segment string) bool {
+	if segment == "" || len(segment) > 4 {
+		return false
+	}
+	for _, c := range segment {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isAllowedSize(size int) bool {
+	for _, allowed := range config.AllowedSizes {
+		if size == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func formatSizes(sizes []int) string {
+	parts := make([]string, len(sizes))
+	for i, size := range sizes {
+		parts[i] = strconv.Itoa(size)
+	}
+	return strings.Join(parts, ", ")
+}
+
 func parseIconName(iconName string) (string, string) {
 	ext := strings.ToLower(filepath.Ext(iconName))
 	if ext != "" {
@@ -281,87 +408,96 @@ func parseIconName(iconName string) (string, string) {
 			return strings.TrimSuffix(iconName, filepath.Ext(iconName)), "webp"
 		}
 	}
-	return iconName, "webp"
+	return iconName, ""
 }
 
-func readLocalFile(path string) (string, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return "", err
-	}
-	return string(data), nil
+// negotiableFormats maps Accept media types to collection formats, in the order
+// preferred when a client rates several of them equally.
+var negotiableFormats = []struct {
+	mediaType string
+	format    string
+}{
+	{"image/avif", "avif"},
+	{"image/webp", "webp"},
+	{"image/png", "png"},
+	{"image/svg+xml", "svg"},
 }
 
-func fetchRemoteFile(url string) (string, error) {
-	resp, err := httpClient.Get(url)
-	if err != nil {
-		return "", err
+// negotiateFormats turns an Accept header into an ordered list of formats to
+// try. Only explicitly named image types count; wildcards say nothing about
+// WebP/AVIF support, so PNG and then WebP are always appended as fallbacks.
+func negotiateFormats(accept string) []string {
+	quality := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(k, "q") {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		quality[mediaType] = q
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	type candidate struct {
+		format string
+		q      float64
 	}
+	var candidates []candidate
+	for _, f := range negotiableFormats {
+		if q, ok := quality[f.mediaType]; ok && q > 0 {
+			candidates = append(candidates, candidate{f.format, q})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
 
-	data, err := io.ReadAll(resp.Body)
+	formats := make([]string, 0, len(candidates)+2)
+	for _, c := range candidates {
+		formats = append(formats, c.format)
+	}
+	for _, fallback := range []string{"png", "webp"} {
+		if !slices.Contains(formats, fallback) {
+			formats = append(formats, fallback)
+		}
+	}
+	return formats
+}
+
+func readLocalFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return "", err
 	}
 	return string(data), nil
 }
 
-func hexRGB(code string) (int64, int64, int64) {
-	r, _ := strconv.ParseInt(code[0:2], 16, 0)
-	g, _ := strconv.ParseInt(code[2:4], 16, 0)
-	b, _ := strconv.ParseInt(code[4:6], 16, 0)
-	return r, g, b
-}
-
-// newWhite returns the replacement for a matched white value, preserving any
-// alpha channel from the original (8-digit hex, #rgba shorthand, or rgba()).
-func newWhite(value, hexColor, code string) string {
-	v := strings.ToLower(value)
-	switch {
-	case strings.HasPrefix(v, "#"):
-		h := v[1:]
-		switch len(h) {
-		case 4: // #rgba shorthand: expand the single alpha nibble
-			return hexColor + strings.Repeat(string(h[3]), 2)
-		case 7: // odd 7-digit form: expand trailing nibble
-			return hexColor + strings.Repeat(string(h[6]), 2)
-		case 8: // #rrggbbaa: keep the alpha byte
-			return hexColor + h[6:8]
-		default: // 3 or 6 digits: fully opaque
-			return hexColor
-		}
-	case strings.HasPrefix(v, "rgba("):
-		inner := value[strings.Index(value, "(")+1 : strings.LastIndex(value, ")")]
-		parts := strings.FieldsFunc(inner, func(r rune) bool {
-			return r == ',' || r == '/' || r == ' ' || r == '\t'
-		})
-		if len(parts) >= 4 {
-			r, g, b := hexRGB(code)
-			return fmt.Sprintf("rgba(%d, %d, %d, %s)", r, g, b, parts[len(parts)-1])
-		}
-		return hexColor
-	default: // "white" keyword or rgb() with no alpha
-		return hexColor
+// writeFileAtomic writes data to name in dir through a temporary file that is
+// renamed into place, so readers never see partial content. Temporary files
+// start with ".tmp-" and are left behind only by a crash.
+func writeFileAtomic(dir, name string, data []byte) error {
+	tmp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
 	}
-}
-
-func applySVGColor(svgContent, colorCode string) string {
-	hexColor := "#" + colorCode
-
-	svgContent = reColorProp.ReplaceAllStringFunc(svgContent, func(m string) string {
-		g := reColorProp.FindStringSubmatch(m)
-		return g[1] + ":" + g[2] + newWhite(g[3], hexColor, colorCode) + g[4]
-	})
-	svgContent = reColorAttr.ReplaceAllStringFunc(svgContent, func(m string) string {
-		g := reColorAttr.FindStringSubmatch(m)
-		return g[1] + "=" + g[2] + newWhite(g[3], hexColor, colorCode) + g[4]
-	})
-
-	return svgContent
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
 
 func serveContent(w http.ResponseWriter, r *http.Request, contentType, content string) {
@@ -369,7 +505,7 @@ func serveContent(w http.ResponseWriter, r *http.Request, contentType, content s
 		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
 		if err == nil {
 			w.Header().Set("Content-Encoding", "gzip")
-			w.Header().Set("Vary", "Accept-Encoding")
+			w.Header().Add("Vary", "Accept-Encoding")
 			defer gz.Close()
 			io.WriteString(gz, content)
 			return
@@ -385,7 +521,12 @@ func writeIconResponse(w http.ResponseWriter, r *http.Request, contentType, cont
 		return
 	}
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(config.CacheTTL.Seconds())))
+	if cacheStatus == "STALE" {
+		// Already past its TTL: let downstream caches reuse it only while we refresh
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=0, stale-while-revalidate=%d, stale-if-error=%d", int(config.CacheStaleTTL.Seconds()), int(config.CacheStaleTTL.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(config.CacheTTL.Seconds())))
+	}
 	w.Header().Set("ETag", etag)
 	w.Header().Set("X-Cache", cacheStatus)
 	serveContent(w, r, contentType, content)
@@ -412,17 +553,307 @@ func getContentType(format string) string {
 	}
 }
 
-func getCacheKey(iconName, colorCode string) string {
-	if colorCode == "" {
-		return iconName + ":default"
+// formatForContentType is the reverse of getContentType for icon formats.
+func formatForContentType(contentType string) string {
+	for _, format := range []string{"svg", "png", "webp", "avif", "ico"} {
+		if getContentType(format) == contentType {
+			return format
+		}
+	}
+	return ""
+}
+
+func getCacheKey(iconName, recolorKey string, size int) string {
+	key := iconName + ":default"
+	if recolorKey != "" {
+		key = iconName + ":" + recolorKey
+	}
+	if size > 0 {
+		key += ":" + strconv.Itoa(size)
+	}
+	return key
+}
+
+// iconResult is the outcome of a cache miss, shared by every request that
+// coalesced onto it.
+type iconResult struct {
+	Content string
+	Format  string
+	Source  string
+
+	// Upstream details for remote icons, kept with the cached item so it can
+	// be revalidated once it expires
+	Origin       string
+	ETag         string
+	LastModified string
+	MaxAge       time.Duration
+}
+
+var errIconNotFound = errors.New("icon not found")
+
+// errIconUnavailable is returned when an icon couldn't be found locally and
+// the remote source failed without saying whether it exists. Unlike a miss it
+// is never cached.
+var errIconUnavailable = errors.New("remote source unavailable")
+
+// renderError reports a failure to generate an icon, carrying the message
+// returned to the client.
+type renderError struct {
+	message string
+	err     error
+}
+
+func (e *renderError) Error() string {
+	return e.message + ": " + e.err.Error()
+}
+
+var iconFlights flightGroup[iconResult]
+
+func remoteResult(path, content, format string, obj RemoteObject) iconResult {
+	source := "remote " + obj.Mirror
+	if obj.FromDisk {
+		source = "remote, disk cache"
+	}
+	return iconResult{
+		Content:      content,
+		Format:       format,
+		Source:       source,
+		Origin:       path,
+		ETag:         obj.ETag,
+		LastModified: obj.LastModified,
+		MaxAge:       obj.MaxAge,
+	}
+}
+
+// saveLocal writes a remote file through to the local volume when enabled.
+func saveLocal(path, content string) {
+	if writeThrough != nil {
+		writeThrough.Write(path, content)
+	}
+}
+
+// inRemoteIndex reports whether a file may exist on the mirrors: it is only
+// ruled out when the remote index has the icon and says the file is absent.
+func inRemoteIndex(name, format string) bool {
+	exists, known := remoteIndex.HasFile(name, format)
+	if known && !exists {
+		logf(logLevelDebug, "[RESOLVE] Skipping %s/%s.%s, not in remote index", format, name, format)
+	}
+	return exists || !known
+}
+
+// lookupIcon finds an icon in the configured sources. Recolored requests
+// always come back as SVG built from the recolor's source SVG; everything else
+// tries each candidate format in order. errIconNotFound is only returned when
+// every source confirmed the icon is missing.
+func lookupIcon(ctx context.Context, baseName string, recolor iconRecolor, candidates []string) (iconResult, error) {
+	sourceName := recolor.sourceName(baseName)
+	if config.IconSource == "local" || config.IconSource == "hybrid" {
+		if recolor.active() {
+			sourcePath := filepath.Join(config.LocalPath, "svg", sourceName+".svg")
+			if content, err := readLocalFile(sourcePath); err == nil {
+				return iconResult{Content: recolor.apply(content), Format: "svg", Source: "local"}, nil
+			}
+		} else {
+			for _, candidate := range candidates {
+				candidatePath := filepath.Join(config.LocalPath, candidate, baseName+"."+candidate)
+				if content, err := readLocalFile(candidatePath); err == nil {
+					return iconResult{Content: content, Format: candidate, Source: "local"}, nil
+				}
+			}
+		}
+	}
+
+	// Files the remote index doesn't list are skipped without a request
+	var remoteErr error
+	if config.IconSource == "remote" || config.IconSource == "hybrid" {
+		if recolor.active() && inRemoteIndex(sourceName, "svg") {
+			sourcePath := "svg/" + sourceName + ".svg"
+			obj, err := fetchRemoteObject(ctx, sourcePath)
+			if err == nil {
+				saveLocal(sourcePath, obj.Content)
+				return remoteResult(sourcePath, recolor.apply(obj.Content), "svg", obj), nil
+			}
+			if !isRemoteMiss(err) {
+				remoteErr = err
+			}
+		} else if !recolor.active() {
+			for _, candidate := range candidates {
+				if !inRemoteIndex(baseName, candidate) {
+					continue
+				}
+				candidatePath := candidate + "/" + baseName + "." + candidate
+				obj, err := fetchRemoteObject(ctx, candidatePath)
+				if err == nil {
+					saveLocal(candidatePath, obj.Content)
+					return remoteResult(candidatePath, obj.Content, candidate, obj), nil
+				}
+				if !isRemoteMiss(err) {
+					// The upstream is failing, so don't wait on it again for
+					// the fallback formats
+					remoteErr = err
+					break
+				}
+			}
+		}
+	}
+
+	if remoteErr != nil {
+		return iconResult{}, fmt.Errorf("%w: %w", errIconUnavailable, remoteErr)
+	}
+	return iconResult{}, errIconNotFound
+}
+
+// withUpstreamDeadline bounds a whole load by REMOTE_DEADLINE, across every
+// file, mirror and retry it takes, so an outage fails fast instead of running
+// past the response timeout. REMOTE_TIMEOUT still limits each attempt, so one
+// hung mirror leaves time for the next.
+func withUpstreamDeadline(fn func(context.Context) (iconResult, error)) func(context.Context) (iconResult, error) {
+	return func(ctx context.Context) (iconResult, error) {
+		ctx, cancel := context.WithTimeout(ctx, config.RemoteDeadline)
+		defer cancel()
+		return fn(ctx)
+	}
+}
+
+// cachedMiss reports whether cacheKey is a remembered miss. The suggestions
+// stored with it are returned too, once a request has computed them.
+func cachedMiss(cacheKey string) ([]Suggestion, bool) {
+	if missCache == nil {
+		return nil, false
+	}
+	item, found := missCache.Get(cacheKey)
+	if !found || item.Content == "" {
+		return nil, found
+	}
+	var suggestions []Suggestion
+	if err := json.Unmarshal([]byte(item.Content), &suggestions); err != nil {
+		return nil, true
+	}
+	return suggestions, true
+}
+
+// rememberSuggestions stores the suggestions for a missing icon with its
+// cached miss, so repeated requests don't search the index again.
+func rememberSuggestions(cacheKey string, suggestions []Suggestion) {
+	if missCache == nil {
+		return
+	}
+	if _, found := missCache.Get(cacheKey); !found {
+		return
+	}
+	if suggestions == nil {
+		suggestions = []Suggestion{}
+	}
+	if content, err := json.Marshal(suggestions); err == nil {
+		missCache.Set(cacheKey, string(content), "application/json")
+	}
+}
+
+// collectionPollInterval is how often the local collection is checked for
+// changes that would invalidate cached misses.
+const collectionPollInterval = 30 * time.Second
+
+// localDir is the listing of a local format directory as of its mtime.
+type localDir struct {
+	modTime time.Time
+	files   map[string]bool
+}
+
+// scanLocalCollection lists the local format directories, reusing the
+// previous listing of any directory whose mtime hasn't changed.
+func scanLocalCollection(prev map[string]localDir) map[string]localDir {
+	dirs := make(map[string]localDir)
+	for _, format := range []string{"svg", "png", "webp", "avif", "ico"} {
+		dir := filepath.Join(config.LocalPath, format)
+		info, err := os.Stat(dir)
+		if err != nil {
+			continue
+		}
+		if p, ok := prev[format]; ok && p.modTime.Equal(info.ModTime()) {
+			dirs[format] = p
+			continue
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		files := make(map[string]bool, len(entries))
+		for _, e := range entries {
+			if !e.IsDir() && !strings.HasPrefix(e.Name(), ".tmp-") {
+				files[e.Name()] = true
+			}
+		}
+		dirs[format] = localDir{modTime: info.ModTime(), files: files}
+	}
+	return dirs
+}
+
+// localCollectionChanged reports whether icons were added or removed between
+// two listings. Files saved by LOCAL_WRITE_THROUGH don't count: they were
+// found remotely, so no cached miss covers them.
+func localCollectionChanged(prev, current map[string]localDir) bool {
+	changed := false
+	for format, dir := range current {
+		if p, ok := prev[format]; ok && p.modTime.Equal(dir.modTime) {
+			continue
+		}
+		for name := range dir.files {
+			// Every new file is checked so the writer forgets all of its own
+			if !prev[format].files[name] && !writeThrough.ownWrite(format+"/"+name) {
+				changed = true
+			}
+		}
+		for name := range prev[format].files {
+			if !dir.files[name] {
+				changed = true
+			}
+		}
+	}
+	for format := range prev {
+		if _, ok := current[format]; !ok {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// watchLocalCollection clears cached misses whenever icons are added to or
+// removed from the local collection, so new icons show up immediately.
+func watchLocalCollection(ctx context.Context) {
+	ticker := time.NewTicker(collectionPollInterval)
+	defer ticker.Stop()
+	dirs := scanLocalCollection(nil)
+	for {
+		select {
+		case <-ticker.C:
+			current := scanLocalCollection(dirs)
+			if localCollectionChanged(dirs, current) {
+				if n := missCache.Clear(); n > 0 {
+					logf(logLevelInfo, "[CACHE] Local collection changed, cleared %d cached misses", n)
+				}
+			}
+			dirs = current
+		case <-ctx.Done():
+			return
+		}
 	}
-	return iconName + ":" + colorCode
 }
 
 func handleIcon(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	iconName := r.PathValue("iconname")
 	colorCode := r.PathValue("colorcode")
+	sizeParam := r.PathValue("size")
+
+	// The last segment of /{iconname}/{colorcode}/dark picks the base variant
+	var baseParam string
+	if sizeParam == "light" || sizeParam == "dark" {
+		baseParam, sizeParam = sizeParam, ""
+	}
+	if sizeParam == "" && isSizeSegment(colorCode) {
+		sizeParam, colorCode = colorCode, ""
+	}
 
 	if iconName == "" {
 		http.Error(w, "Icon name is required", http.StatusBadRequest)
@@ -430,7 +861,6 @@ func handleIcon(w http.ResponseWriter, r *http.Request) {
 	}
 
 	baseName, format := parseIconName(iconName)
-	baseName = strings.ToLower(baseName)
 
 	if strings.Contains(baseName, "..") || strings.Contains(baseName, "/") || strings.Contains(baseName, "\\") {
 		logf(logLevelError, "[ERROR] Invalid icon name, path traversal attempt: \"%s\"", iconName)
@@ -438,9 +868,35 @@ func handleIcon(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	resolved, renamed := iconIndex.Resolve(baseName)
+	if renamed {
+		target := "/" + url.PathEscape(resolved+iconName[len(baseName):])
+		if _, rest, found := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/"); found {
+			target += "/" + rest
+		}
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		logf(logLevelInfo, "[REDIRECT] Icon \"%s\" was renamed to \"%s\"", baseName, resolved)
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+		return
+	}
+	if resolved != strings.ToLower(baseName) {
+		logf(logLevelDebug, "[RESOLVE] Resolved icon \"%s\" to \"%s\"", baseName, resolved)
+	}
+	baseName = resolved
+
+	// A color segment containing ':' is a color map rather than a color
+	var mapSpec string
+	if strings.Contains(colorCode, ":") {
+		mapSpec, colorCode = colorCode, ""
+	}
 	if colorCode == "" {
 		colorCode = strings.TrimPrefix(r.URL.Query().Get("color"), "#")
 	}
+	if mapSpec == "" {
+		mapSpec = r.URL.Query().Get("map")
+	}
 
 	primaryFallback := false
 	if colorCode == "primary" {
@@ -456,110 +912,361 @@ func handleIcon(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var contentType string
-	var formatToServe string
+	recolor := iconRecolor{Color: colorCode}
+	if mapSpec != "" {
+		if colorCode != "" {
+			http.Error(w, "Color and map cannot be combined", http.StatusBadRequest)
+			return
+		}
+		pairs, err := parseColorMap(mapSpec)
+		if err != nil {
+			logf(logLevelError, "[ERROR] Invalid color map for icon \"%s\": %v", baseName, err)
+			http.Error(w, "Invalid color map: "+err.Error()+". Use source:target pairs such as 000000:ff0000,fff:00ff00", http.StatusBadRequest)
+			return
+		}
+		recolor.Map = pairs
+	}
 
-	if colorCode != "" {
-		contentType = "image/svg+xml"
-		formatToServe = "svg"
-	} else {
-		formatToServe = format
-		contentType = getContentType(formatToServe)
+	if toleranceParam := r.URL.Query().Get("tolerance"); toleranceParam != "" {
+		n, err := strconv.Atoi(toleranceParam)
+		if err != nil || n < 0 || n > 255 {
+			logf(logLevelError, "[ERROR] Invalid tolerance for icon \"%s\": %s", baseName, toleranceParam)
+			http.Error(w, "Invalid tolerance. Use a number from 0 to 255", http.StatusBadRequest)
+			return
+		}
+		recolor.Tolerance = n
 	}
 
-	cacheKey := getCacheKey(baseName+"."+formatToServe, colorCode)
+	if baseParam == "" {
+		baseParam = r.URL.Query().Get("base")
+	}
+	switch baseParam {
+	case "", "light":
+	case "dark":
+		recolor.Dark = true
+	default:
+		logf(logLevelError, "[ERROR] Invalid base variant for icon \"%s\": %s", baseName, baseParam)
+		http.Error(w, "Invalid base. Use light or dark", http.StatusBadRequest)
+		return
+	}
+	if recolor.Dark && colorCode == "" {
+		logf(logLevelDebug, "[WARN] Base variant only applies to colorized icons, ignoring: \"%s\"", baseName)
+		recolor.Dark = false
+	}
+
+	// ?variant= picks the -light or -dark variant of the icon, falling back to
+	// the icon itself when the collection doesn't have it. Light variants are
+	// made for dark backgrounds, so auto picks the one opposite the client's
+	// color scheme, and adaptive merges both into an SVG that switches itself.
+	adaptive := false
+	variant := r.URL.Query().Get("variant")
+	if variant == "auto" {
+		w.Header().Set("Accept-CH", "Sec-CH-Prefers-Color-Scheme")
+		w.Header().Add("Vary", "Sec-CH-Prefers-Color-Scheme")
+		switch strings.Trim(r.Header.Get("Sec-CH-Prefers-Color-Scheme"), `"`) {
+		case "dark":
+			variant = "light"
+		case "light":
+			variant = "dark"
+		default:
+			variant = ""
+		}
+	}
+	switch variant {
+	case "":
+	case "light", "dark":
+		if recolor.active() {
+			logf(logLevelDebug, "[WARN] Variant does not apply to colorized icons, ignoring: \"%s\"", baseName)
+		} else if variantName := iconIndex.Variant(baseName, "-"+variant); variantName != baseName {
+			baseName = variantName
+		} else {
+			logf(logLevelDebug, "[RESOLVE] Icon \"%s\" has no %s variant, serving the base icon", baseName, variant)
+		}
+	case "adaptive":
+		switch {
+		case recolor.active():
+			logf(logLevelDebug, "[WARN] Variant does not apply to colorized icons, ignoring: \"%s\"", baseName)
+		case format != "" && format != "svg":
+			logf(logLevelError, "[ERROR] Adaptive variant requested as %s for icon \"%s\"", format, baseName)
+			http.Error(w, "The adaptive variant is only available as SVG", http.StatusBadRequest)
+			return
+		case iconIndex.Variant(baseName, "-light") == baseName || iconIndex.Variant(baseName, "-dark") == baseName:
+			logf(logLevelDebug, "[RESOLVE] Icon \"%s\" lacks a light or dark variant, serving the base icon", baseName)
+		default:
+			adaptive = true
+			format = "svg"
+		}
+	default:
+		logf(logLevelError, "[ERROR] Invalid variant for icon \"%s\": %s", baseName, variant)
+		http.Error(w, "Invalid variant. Use light, dark, auto or adaptive", http.StatusBadRequest)
+		return
+	}
 
-	var colorSuffix string
-	if colorCode != "" {
-		colorSuffix = " with color " + colorCode
+	if sizeParam == "" {
+		sizeParam = r.URL.Query().Get("size")
 	}
 
-	if cached, found := cache.Get(cacheKey); found {
+	size := 0
+	if sizeParam != "" {
+		n, err := strconv.Atoi(sizeParam)
+		if err != nil || !isAllowedSize(n) {
+			logf(logLevelError, "[ERROR] Invalid size for icon \"%s\": %s", baseName, sizeParam)
+			http.Error(w, "Invalid size. Allowed sizes: "+formatSizes(config.AllowedSizes), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+
+	// Without an extension, recolored icons keep their original SVG output and
+	// everything else is negotiated from the Accept header
+	var negotiated []string
+	if format == "" {
+		if recolor.active() {
+			format = "svg"
+		} else {
+			negotiated = negotiateFormats(r.Header.Get("Accept"))
+			if size > 0 {
+				// Resized output can only be encoded as PNG or WebP
+				negotiated = slices.DeleteFunc(negotiated, func(f string) bool { return f == "avif" || f == "svg" })
+			}
+			format = negotiated[0]
+			w.Header().Add("Vary", "Accept")
+		}
+	}
+
+	// SVGs scale on their own, so sizing only applies to raster output
+	if format == "svg" && size > 0 {
+		logf(logLevelDebug, "[WARN] Size is not applicable to SVG icons, ignoring: \"%s\"", baseName)
+		size = 0
+	}
+
+	formatToServe := format
+	if formatToServe == "avif" && (recolor.active() || size > 0) {
+		logf(logLevelDebug, "[WARN] AVIF cannot be generated on the fly, serving webp instead: \"%s\"", baseName)
+		formatToServe = "webp"
+	}
+
+	// Formats to look for in order, falling back to WebP when the requested
+	// format doesn't exist for this icon
+	candidates := []string{formatToServe}
+	if negotiated != nil {
+		candidates = negotiated
+	} else if formatToServe != "webp" {
+		candidates = append(candidates, "webp")
+	}
+
+	requested := formatToServe
+	if negotiated != nil {
+		requested = strings.Join(negotiated, ",")
+	} else if adaptive {
+		requested = "adaptive.svg"
+	}
+	cacheKey := getCacheKey(baseName+"."+requested, recolor.key(), size)
+
+	colorSuffix := recolor.describe()
+	if adaptive {
+		colorSuffix += " as adaptive SVG"
+	}
+	if size > 0 {
+		colorSuffix += fmt.Sprintf(" at %dpx", size)
+	}
+
+	cached, state := cache.Lookup(cacheKey)
+	if state == cacheFresh {
 		logf(logLevelDebug, "[CACHE] Serving cached icon: \"%s\"%s (%s) %v", baseName, colorSuffix, formatToServe, formatDuration(time.Since(start)))
 		writeIconResponse(w, r, cached.ContentType, cached.Content, "HIT")
 		return
 	}
 
-	var iconContent string
-	var servedFrom string
-
-	if config.IconSource == "local" || config.IconSource == "hybrid" {
-		if colorCode != "" {
-			lightPath := filepath.Join(config.LocalPath, "svg", baseName+"-light.svg")
-			if content, err := readLocalFile(lightPath); err == nil {
-				iconContent = applySVGColor(content, colorCode)
-				servedFrom = "local"
-			}
+	// Identical concurrent misses share a single lookup and render per cache
+	// key. baseName and cacheKey are read when the load runs, so a suggestion
+	// fallback below reuses it for the matched icon.
+	var render func(iconResult) (iconResult, error)
+	load := func(ctx context.Context) (iconResult, error) {
+		var result iconResult
+		var err error
+		if adaptive {
+			result, err = lookupAdaptive(ctx, baseName)
 		} else {
-			var standardPath string
-			if formatToServe == "svg" {
-				standardPath = filepath.Join(config.LocalPath, "svg", baseName+".svg")
-			} else {
-				standardPath = filepath.Join(config.LocalPath, formatToServe, baseName+"."+formatToServe)
+			result, err = lookupIcon(ctx, baseName, recolor, candidates)
+		}
+		if err != nil {
+			if errors.Is(err, errIconNotFound) && missCache != nil {
+				missCache.Set(cacheKey, "", "")
 			}
-			iconContent, _ = readLocalFile(standardPath)
-
-			if iconContent == "" && formatToServe != "webp" {
-				webpPath := filepath.Join(config.LocalPath, "webp", baseName+".webp")
-				if content, err := readLocalFile(webpPath); err == nil {
-					iconContent = content
-					contentType = "image/webp"
-					formatToServe = "webp"
-				}
+			return iconResult{}, err
+		}
+		return render(result)
+	}
+
+	// render turns a looked up icon into the requested format and size and
+	// caches it.
+	render = func(result iconResult) (iconResult, error) {
+		// Recolored icons are always looked up as SVG and rendered from there
+		if recolor.active() {
+			result.Format = formatToServe
+		}
+
+		content := result.Content
+		if recolor.active() && result.Format != "svg" {
+			raster, err := renderSVG(content, result.Format, size)
+			if err != nil {
+				return iconResult{}, &renderError{message: "Failed to render icon", err: err}
 			}
-			if iconContent != "" {
-				servedFrom = "local"
+			result.Content = raster
+		} else if size > 0 {
+			resized, err := resizeRaster(content, result.Format, size)
+			if err != nil {
+				return iconResult{}, &renderError{message: "Failed to resize icon", err: err}
 			}
+			result.Content = resized
 		}
+
+		cache.SetItem(cacheKey, CacheItem{
+			Content:      result.Content,
+			ContentType:  getContentType(result.Format),
+			TTL:          upstreamTTL(result.MaxAge),
+			Origin:       result.Origin,
+			ETag:         result.ETag,
+			LastModified: result.LastModified,
+		})
+		return result, nil
 	}
 
-	if iconContent == "" && (config.IconSource == "remote" || config.IconSource == "hybrid") {
-		if colorCode != "" {
-			lightURL := config.RemoteURL + "/svg/" + baseName + "-light.svg"
-			if content, err := fetchRemoteFile(lightURL); err == nil {
-				iconContent = applySVGColor(content, colorCode)
-				servedFrom = "remote"
-			}
-		} else {
-			var standardURL string
-			if formatToServe == "svg" {
-				standardURL = config.RemoteURL + "/svg/" + baseName + ".svg"
+	// refresh brings a stale item up to date with a request against its
+	// upstream origin, conditional when it has validators, so an unchanged
+	// icon isn't downloaded and rendered again and a changed one is only
+	// downloaded once. Items from more than one file have no origin and are
+	// loaded again.
+	refresh := func(ctx context.Context) (iconResult, error) {
+		if cached.Origin == "" {
+			return load(ctx)
+		}
+		obj, err := mirrors.request(ctx, cached.Origin, cached.ETag, cached.LastModified)
+		if err != nil {
+			return iconResult{}, err
+		}
+		if obj.NotModified {
+			cache.Touch(cacheKey, upstreamTTL(obj.MaxAge))
+			logf(logLevelDebug, "[CACHE] Revalidated icon: \"%s\"%s (%s)", baseName, colorSuffix, obj.Mirror)
+			// A negotiated request may have cached a fallback format
+			return iconResult{Content: cached.Content, Format: formatForContentType(cached.ContentType), Source: "remote " + obj.Mirror}, nil
+		}
+
+		if diskCache != nil {
+			diskCache.Set(cached.Origin, obj)
+		}
+		saveLocal(cached.Origin, obj.Content)
+		content, format := obj.Content, strings.TrimPrefix(filepath.Ext(cached.Origin), ".")
+		if recolor.active() {
+			content = recolor.apply(content)
+		}
+		return render(remoteResult(cached.Origin, content, format, obj))
+	}
+
+	// Expired remote icons are served right away and refreshed in the
+	// background, outliving the request. A failed refresh leaves the stale
+	// copy in place, so it keeps being served until the grace period runs out.
+	if state == cacheStale && config.IconSource != "local" {
+		go func() {
+			if _, err, _ := iconFlights.Do(shutdownCtx, cacheKey, withUpstreamDeadline(refresh)); err != nil {
+				logf(logLevelError, "[WARN] Failed to refresh stale icon \"%s\"%s, keeping stale copy: %v", baseName, colorSuffix, err)
 			} else {
-				standardURL = config.RemoteURL + "/" + formatToServe + "/" + baseName + "." + formatToServe
+				logf(logLevelDebug, "[CACHE] Refreshed stale icon: \"%s\"%s", baseName, colorSuffix)
 			}
-			iconContent, _ = fetchRemoteFile(standardURL)
-
-			if iconContent == "" && formatToServe != "webp" {
-				webpURL := config.RemoteURL + "/webp/" + baseName + ".webp"
-				if content, err := fetchRemoteFile(webpURL); err == nil {
-					iconContent = content
-					contentType = "image/webp"
-					formatToServe = "webp"
-				}
-			}
-			if iconContent != "" {
-				servedFrom = "remote"
+		}()
+		logf(logLevelDebug, "[CACHE] Serving stale icon: \"%s\"%s (%s) %v", baseName, colorSuffix, formatToServe, formatDuration(time.Since(start)))
+		writeIconResponse(w, r, cached.ContentType, cached.Content, "STALE")
+		return
+	}
+
+	// Misses are remembered for CACHE_NOT_FOUND_TTL so broken links don't
+	// repeat every local and remote lookup
+	var result iconResult
+	var err error
+	var shared bool
+	suggestions, missed := cachedMiss(cacheKey)
+	if missed {
+		w.Header().Set("X-Cache", "HIT")
+		err = errIconNotFound
+	} else {
+		result, err, shared = iconFlights.Do(r.Context(), cacheKey, withUpstreamDeadline(load))
+	}
+
+	if errors.Is(err, errIconNotFound) {
+		if suggestions == nil {
+			suggestions = suggestIcons(baseName)
+			rememberSuggestions(cacheKey, suggestions)
+		}
+		if match, ok := confidentSuggestion(suggestions); ok && r.URL.Query().Get("fallback") == "suggest" {
+			logf(logLevelInfo, "[WARN] Icon not found: \"%s\", falling back to closest match \"%s\" (score %.2f)", baseName, match.Reference, match.Score)
+			baseName = strings.ToLower(match.Reference)
+			cacheKey = getCacheKey(baseName+"."+requested, recolor.key(), size)
+			if cached, found := cache.Get(cacheKey); found {
+				writeIconResponse(w, r, cached.ContentType, cached.Content, "HIT")
+				return
 			}
+			result, err, shared = iconFlights.Do(r.Context(), cacheKey, withUpstreamDeadline(load))
 		}
 	}
 
-	if iconContent == "" {
+	// The client disconnected or the server is shutting down; the latter
+	// still gets an answer it can retry
+	if r.Context().Err() != nil {
+		logf(logLevelDebug, "[WARN] Request for icon \"%s\"%s canceled: %v (%v)", baseName, colorSuffix, r.Context().Err(), formatDuration(time.Since(start)))
+		http.Error(w, "Request canceled", http.StatusServiceUnavailable)
+		return
+	}
+
+	if errors.Is(err, errIconNotFound) {
 		logf(logLevelError, "[ERROR] Icon not found: \"%s\"%s (source: %s) %v", baseName, colorSuffix, config.IconSource, formatDuration(time.Since(start)))
-		http.Error(w, "Icon not found", http.StatusNotFound)
+		writeIconNotFound(w, r, suggestions)
 		return
 	}
 
-	cache.Set(cacheKey, iconContent, contentType)
+	if errors.Is(err, errQueueFull) {
+		logf(logLevelError, "[WARN] Upstream queue full, rejecting icon \"%s\"%s (%v)", baseName, colorSuffix, formatDuration(time.Since(start)))
+		w.Header().Set("Retry-After", strconv.Itoa(queueRetryAfter))
+		http.Error(w, "Too many requests to the icon source, try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errCircuitOpen) {
+		logf(logLevelError, "[ERROR] Failed to fetch icon \"%s\"%s: %v (%v)", baseName, colorSuffix, err, formatDuration(time.Since(start)))
+		w.Header().Set("Retry-After", strconv.Itoa(int(config.MirrorCooldown.Seconds())))
+		http.Error(w, "Icon source unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errIconUnavailable) {
+		logf(logLevelError, "[ERROR] Failed to fetch icon \"%s\"%s: %v (%v)", baseName, colorSuffix, err, formatDuration(time.Since(start)))
+		http.Error(w, "Icon source unavailable", http.StatusBadGateway)
+		return
+	}
 
-	level := "SUCCESS"
-	detail := colorSuffix
-	if primaryFallback {
-		level = "WARN"
-		detail = " (PRIMARY_COLOR not set, using default format)"
+	var renderErr *renderError
+	if errors.As(err, &renderErr) {
+		logf(logLevelError, "[ERROR] %s \"%s\"%s: %v (%v)", renderErr.message, baseName, colorSuffix, renderErr.err, formatDuration(time.Since(start)))
+		http.Error(w, renderErr.message, http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		logf(logLevelError, "[ERROR] Failed to load icon \"%s\"%s: %v (%v)", baseName, colorSuffix, err, formatDuration(time.Since(start)))
+		http.Error(w, "Failed to load icon", http.StatusInternalServerError)
+		return
 	}
-	logf(logLevelInfo, "[%s] Serving icon: \"%s\"%s (%s, source: %s) %v", level, baseName, detail, formatToServe, servedFrom, formatDuration(time.Since(start)))
 
-	writeIconResponse(w, r, contentType, iconContent, "MISS")
+	if shared {
+		logf(logLevelDebug, "[CACHE] Serving coalesced icon: \"%s\"%s (%s) %v", baseName, colorSuffix, result.Format, formatDuration(time.Since(start)))
+	} else {
+		level := "SUCCESS"
+		detail := colorSuffix
+		if primaryFallback {
+			level = "WARN"
+			detail = " (PRIMARY_COLOR not set, using default format)"
+		}
+		logf(logLevelInfo, "[%s] Serving icon: \"%s\"%s (%s, source: %s) %v", level, baseName, detail, result.Format, result.Source, formatDuration(time.Since(start)))
+	}
+
+	writeIconResponse(w, r, getContentType(result.Format), result.Content, "MISS")
 }
 
 func handleCustomIcon(w http.ResponseWriter, r *http.Request) {
@@ -659,8 +1366,30 @@ func main() {
 
 	config = loadConfig()
 	validateConfig(config)
-	cache = NewCache(config.CacheTTL, config.CacheSize)
-	httpClient = &http.Client{Timeout: config.RemoteTimeout}
+	cache = NewCache(config.CacheTTL, config.CacheStaleTTL, config.CacheSize, config.CacheMaxBytes)
+	if config.CacheNotFoundTTL > 0 {
+		// Misses have a budget of their own so a scan of random names can't
+		// evict icons, while their suggestions still count against it
+		missCache = NewCache(config.CacheNotFoundTTL, 0, config.CacheNotFoundSize, config.CacheNotFoundMax)
+	}
+	if config.CacheDir != "" && config.IconSource != "local" {
+		dc, err := NewDiskCache(config.CacheDir, config.DiskCacheTTL, config.CacheStaleTTL, config.DiskCacheMax)
+		if err != nil {
+			log.Fatalf("[ERROR] Cache directory \"%s\" is not usable: %v", config.CacheDir, err)
+		}
+		diskCache = dc
+	}
+	// Keep enough idle connections per host to reuse them across a burst,
+	// but never open more than the fetch limit allows
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = config.RemoteConcurrency
+	transport.MaxIdleConnsPerHost = config.RemoteConcurrency
+	httpClient = &http.Client{Timeout: config.RemoteTimeout, Transport: transport}
+	if config.LocalWriteThrough && config.IconSource == "hybrid" {
+		writeThrough = newLocalWriter(config.LocalWriteMax)
+	}
+	upstreamLimiter = newFetchLimiter(config.RemoteConcurrency, config.RemoteQueueSize)
+	mirrors = NewMirrorSet(config.RemoteURLs, config.MirrorMaxFailures, config.MirrorCooldown)
 
 	mux := http.NewServeMux()
 
@@ -670,20 +1399,30 @@ func main() {
 			return
 		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		fmt.Fprintf(w, "selfh.st/icons\n\nEndpoints:\n  GET /{iconname}\n  GET /{iconname}/{colorcode}\n  GET /custom/{filename}\n  GET /health\n")
+		fmt.Fprintf(w, "selfh.st/icons\n\nEndpoints:\n  GET /{iconname}\n  GET /{iconname}/{colorcode}\n  GET /{iconname}/{colormap}\n  GET /{iconname}/{colorcode}/{size}\n  GET /{iconname}/{colorcode}/dark\n  GET /custom/{filename}\n  GET /api/icons\n  GET /api/icons/{reference}\n  GET /health\n")
 	})
 
 	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
+		health := map[string]any{"status": "ok"}
+		if config.IconSource != "local" {
+			active, queued := upstreamLimiter.stats()
+			health["mirrors"] = mirrors.Status()
+			health["upstream"] = map[string]int{"active": active, "queued": queued}
+		}
+		writeJSON(w, http.StatusOK, health)
 	})
 
 	mux.HandleFunc("GET /custom/{filename}", handleCustomIcon)
 
+	mux.HandleFunc("GET /api/icons", handleAPIIcons)
+	mux.HandleFunc("GET /api/icons/{reference}", handleAPIIcon)
+
 	// Suppress favicon load error message in logs when viewing via browser
 	mux.HandleFunc("GET /favicon.ico", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNoContent)
 	})
 
+	mux.HandleFunc("GET /{iconname}/{colorcode}/{size}", handleIcon)
 	mux.HandleFunc("GET /{iconname}/{colorcode}", handleIcon)
 	mux.HandleFunc("GET /{iconname}", handleIcon)
 
@@ -693,21 +1432,55 @@ func main() {
 		case "local":
 			return "Local volume"
 		case "hybrid":
-			return "Hybrid (local with remote fallback: " + config.RemoteURL + ")"
+			return "Hybrid (local with remote fallback: " + strings.Join(config.RemoteURLs, ", ") + ")"
 		default:
-			return "Remote: " + config.RemoteURL
+			return "Remote: " + strings.Join(config.RemoteURLs, ", ")
 		}
 	}())
-	log.Printf("Cache settings: TTL %ds, Max %d items", int(config.CacheTTL.Seconds()), config.CacheSize)
+	log.Printf("Cache settings: TTL %ds (stale grace %ds), Max %d items, %s", int(config.CacheTTL.Seconds()), int(config.CacheStaleTTL.Seconds()), config.CacheSize, formatBytes(config.CacheMaxBytes))
+	if missCache != nil {
+		log.Printf("Not found cache: TTL %ds, Max %d items, %s", int(config.CacheNotFoundTTL.Seconds()), config.CacheNotFoundSize, formatBytes(config.CacheNotFoundMax))
+	}
+	if config.IconSource != "local" {
+		log.Printf("Remote fetches: max %d concurrent, queue %d, %d retries, max %s, deadline %ds", config.RemoteConcurrency, config.RemoteQueueSize, config.RemoteRetries, formatBytes(config.RemoteMaxBytes), int(config.RemoteDeadline.Seconds()))
+	}
+	if writeThrough != nil {
+		log.Printf("Local write-through: %s (Max %s)", config.LocalPath, formatBytes(config.LocalWriteMax))
+	}
+	if diskCache != nil {
+		log.Printf("Disk cache: %s (TTL %ds, Max %s)", config.CacheDir, int(config.DiskCacheTTL.Seconds()), formatBytes(config.DiskCacheMax))
+	}
+	if err := iconIndex.Load(shutdownCtx); err != nil {
+		log.Printf("[WARN] Icon index unavailable, API requests will retry: %v", err)
+	} else {
+		log.Printf("Icon index: %d icons (%s)", len(iconIndex.entries), iconIndex.source)
+	}
+	switch config.IconSource {
+	case "remote":
+		remoteIndex = iconIndex
+	case "hybrid":
+		remoteIndex = &IconIndex{remoteOnly: true}
+		if err := remoteIndex.Load(shutdownCtx); err != nil {
+			log.Printf("[WARN] Remote icon index unavailable, every remote file will be tried: %v", err)
+		} else {
+			log.Printf("Remote icon index: %d icons", len(remoteIndex.entries))
+		}
+	}
+	if remoteIndex != nil {
+		log.Printf("Remote index refresh: every %ds", int(config.IndexRefresh.Seconds()))
+	}
+	log.Printf("Allowed sizes: %s", formatSizes(config.AllowedSizes))
 	log.Printf("Log level: %s", []string{"debug", "info", "error"}[config.LogLevel])
 
 	server := &http.Server{
 		Addr:         ":" + config.Port,
 		Handler:      corsMiddleware(mux),
 		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		WriteTimeout: serverWriteTimeout,
 		IdleTimeout:  60 * time.Second,
+		BaseContext:  func(net.Listener) context.Context { return shutdownCtx },
 	}
+	server.RegisterOnShutdown(cancelShutdown)
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -720,12 +1493,27 @@ func main() {
 			select {
 			case <-ticker.C:
 				cache.cleanup()
+				if missCache != nil {
+					missCache.cleanup()
+				}
+				if diskCache != nil {
+					diskCache.cleanup()
+				}
 			case <-cleanupCtx.Done():
 				return
 			}
 		}
 	}()
 
+	if config.IconSource != "local" {
+		go mirrors.probeLoop(cleanupCtx)
+		go remoteIndex.refreshLoop(shutdownCtx, config.IndexRefresh)
+	}
+
+	if missCache != nil && config.IconSource != "remote" {
+		go watchLocalCollection(cleanupCtx)
+	}
+
 	go func() {
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorProbeInterval is how often mirrors past their cooldown are probed.
+const mirrorProbeInterval = 5 * time.Second
+
+// errCircuitOpen is returned without making a request while every mirror is
+// failing.
+var errCircuitOpen = errors.New("circuit open, all mirrors are failing")
+
+// defaultLayout is the directory layout of the collection, used for mirrors
+// given as a plain base URL.
+const defaultLayout = "/{format}/{name}{variant}.{ext}"
+
+var templatePlaceholderRe = regexp.MustCompile(`\{[^{}]*\}`)
+
+// templatePlaceholders are the placeholders a REMOTE_URL template may use.
+var templatePlaceholders = []string{"{format}", "{name}", "{variant}", "{ext}"}
+
+// validateTemplate reports a problem with a REMOTE_URL entry, if any.
+func validateTemplate(u string) error {
+	if !strings.Contains(u, "{") {
+		return nil
+	}
+	for _, p := range templatePlaceholderRe.FindAllString(u, -1) {
+		if !slices.Contains(templatePlaceholders, p) {
+			return fmt.Errorf("unknown placeholder %s", p)
+		}
+	}
+	// Without {variant}, requests for plex-light.svg would quietly get plex.svg
+	for _, required := range []string{"{name}", "{variant}"} {
+		if !strings.Contains(u, required) {
+			return fmt.Errorf("template is missing %s", required)
+		}
+	}
+	return nil
+}
+
+// Mirror is one entry from REMOTE_URL along with its recent health. The entry
+// is either a base URL laid out like the collection or a URL template.
+type Mirror struct {
+	URL        string
+	template   string
+	root       string
+	failures   int
+	probeAt    time.Time
+	open       bool
+	lastError  string
+	served     int64
+	lastServed time.Time
+}
+
+// MirrorStatus is a snapshot of a mirror for the /health endpoint.
+type MirrorStatus struct {
+	URL        string     `json:"url"`
+	Healthy    bool       `json:"healthy"`
+	Failures   int        `json:"consecutive_failures"`
+	LastError  string     `json:"last_error,omitempty"`
+	Served     int64      `json:"served"`
+	LastServed *time.Time `json:"last_served,omitempty"`
+}
+
+// MirrorSet tries mirrors in priority order, with a circuit breaker for each.
+// A mirror that fails maxFailures times in a row has its circuit opened and is
+// skipped; once the cooldown has passed it goes half-open and a background
+// probe decides whether to close the circuit or wait another cooldown.
+type MirrorSet struct {
+	mirrors     []*Mirror
+	maxFailures int
+	cooldown    time.Duration
+	mutex       sync.Mutex
+}
+
+var mirrors *MirrorSet
+
+func NewMirrorSet(urls []string, maxFailures int, cooldown time.Duration) *MirrorSet {
+	m := &MirrorSet{maxFailures: maxFailures, cooldown: cooldown}
+	for _, u := range urls {
+		mirror := &Mirror{URL: u, template: u + defaultLayout, root: u + "/"}
+		if i := strings.Index(u, "{"); i >= 0 {
+			// Files at the root of the collection (index.json) live in the
+			// directory above the first placeholder
+			mirror.template = u
+			mirror.root = u[:strings.LastIndex(u[:i], "/")+1]
+		}
+		m.mirrors = append(m.mirrors, mirror)
+	}
+	return m
+}
+
+// fileURL maps a path within the collection, such as "svg/plex-light.svg" or
+// "index.json", to its URL on this mirror.
+func (mirror *Mirror) fileURL(file string) string {
+	dir, base := path.Split(file)
+	if dir == "" {
+		return mirror.root + base
+	}
+	ext := path.Ext(base)
+	name, variant := strings.TrimSuffix(base, ext), ""
+	for _, suffix := range variantSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			name, variant = strings.TrimSuffix(name, suffix), suffix
+			break
+		}
+	}
+	return strings.NewReplacer(
+		"{format}", strings.TrimSuffix(dir, "/"),
+		"{name}", name,
+		"{variant}", variant,
+		"{ext}", strings.TrimPrefix(ext, "."),
+	).Replace(mirror.template)
+}
+
+// candidates returns the mirrors with a closed circuit, in priority order.
+func (m *MirrorSet) candidates() []*Mirror {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var healthy []*Mirror
+	for _, mirror := range m.mirrors {
+		if !mirror.open {
+			healthy = append(healthy, mirror)
+		}
+	}
+	return healthy
+}
+
+func (m *MirrorSet) markServed(mirror *Mirror) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mirror.failures = 0
+	mirror.served++
+	mirror.lastServed = time.Now()
+}
+
+func (m *MirrorSet) markFailed(mirror *Mirror, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	mirror.failures++
+	mirror.lastError = err.Error()
+	if !mirror.open && mirror.failures >= m.maxFailures {
+		mirror.open = true
+		mirror.probeAt = time.Now().Add(m.cooldown)
+		logf(logLevelError, "[WARN] Circuit open for mirror %s after %d consecutive failures, probing again in %ds: %v", mirror.URL, mirror.failures, int(m.cooldown.Seconds()), err)
+	}
+}
+
+// request fetches a path relative to the collection root from the first
+// mirror that has it, retrying transient failures before moving on. Mirrors
+// may lag behind each other, so a 404 moves on to the next one as well and
+// errRemoteNotFound is only returned when every mirror missed. A body that
+// fails validation counts as a failure of the mirror that sent it.
+func (m *MirrorSet) request(ctx context.Context, path, etag, lastModified string) (RemoteObject, error) {
+	lastErr := errCircuitOpen
+	failed, missed := false, false
+	for _, mirror := range m.candidates() {
+		obj, err := requestWithRetry(ctx, mirror.fileURL(path), etag, lastModified)
+		if err == nil && !obj.NotModified {
+			if verr := validateContent(obj.Content, path); verr != nil {
+				err = fmt.Errorf("%w: %v", errRemoteRejected, verr)
+			}
+		}
+		if errors.Is(err, errRemoteRejected) {
+			logf(logLevelError, "[WARN] Rejected remote response for %s from %s: %v", path, mirror.URL, err)
+		}
+		if err == nil {
+			m.markServed(mirror)
+			obj.Mirror = mirror.URL
+			return obj, nil
+		}
+		if isRemoteMiss(err) {
+			m.markServed(mirror)
+			missed = true
+			logf(logLevelDebug, "[MIRROR] Mirror %s doesn't have \"%s\"", mirror.URL, path)
+			continue
+		}
+		// A canceled or queued-out request says nothing about the mirror
+		if ctx.Err() != nil {
+			return RemoteObject{}, ctx.Err()
+		}
+		if errors.Is(err, errQueueFull) {
+			return RemoteObject{}, err
+		}
+		logf(logLevelDebug, "[WARN] Mirror %s failed for \"%s\": %v", mirror.URL, path, err)
+		m.markFailed(mirror, err)
+		failed = true
+		lastErr = err
+	}
+	// A failed mirror might have had the file, so that isn't a miss
+	if missed && !failed {
+		return RemoteObject{}, errRemoteNotFound
+	}
+	return RemoteObject{}, lastErr
+}
+
+// probe is the half-open check of whether a mirror is reachable again. Any
+// response short of a server error counts, since mirrors don't all serve the
+// same files.
+func probe(mirror *Mirror) error {
+	req, err := http.NewRequest(http.MethodHead, mirror.fileURL("index.json"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests {
+		return &httpStatusError{resp.StatusCode}
+	}
+	return nil
+}
+
+// probeDown probes every mirror whose cooldown has run out, closing the
+// circuit of the ones that respond and extending the cooldown of the rest.
+func (m *MirrorSet) probeDown() {
+	m.mutex.Lock()
+	var due []*Mirror
+	for _, mirror := range m.mirrors {
+		if mirror.open && time.Now().After(mirror.probeAt) {
+			due = append(due, mirror)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, mirror := range due {
+		err := probe(mirror)
+		m.mutex.Lock()
+		if err == nil {
+			mirror.open = false
+			mirror.failures = 0
+			logf(logLevelInfo, "[MIRROR] Circuit closed for mirror %s, probe succeeded", mirror.URL)
+		} else {
+			mirror.lastError = err.Error()
+			mirror.probeAt = time.Now().Add(m.cooldown)
+			logf(logLevelDebug, "[MIRROR] Mirror %s is still failing: %v", mirror.URL, err)
+		}
+		m.mutex.Unlock()
+	}
+}
+
+func (m *MirrorSet) probeLoop(ctx context.Context) {
+	ticker := time.NewTicker(mirrorProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.probeDown()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *MirrorSet) Status() []MirrorStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	status := make([]MirrorStatus, 0, len(m.mirrors))
+	for _, mirror := range m.mirrors {
+		s := MirrorStatus{
+			URL:       mirror.URL,
+			Healthy:   !mirror.open,
+			Failures:  mirror.failures,
+			LastError: mirror.lastError,
+			Served:    mirror.served,
+		}
+		if !mirror.lastServed.IsZero() {
+			lastServed := mirror.lastServed
+			s.LastServed = &lastServed
+		}
+		status = append(status, s)
+	}
+	return status
+}
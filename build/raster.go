@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// rasterSize matches the dimensions of the PNG and WebP files in the collection.
+const rasterSize = 512
+
+// icoSizes matches the sizes embedded in the ICO files in the collection.
+var icoSizes = []int{16, 32, 48, 64, 128}
+
+// Bounds for the ALLOWED_SIZES whitelist used by on-the-fly resizing.
+const (
+	minResizeSize = 8
+	maxResizeSize = 1024
+)
+
+// fitRect returns the offset and dimensions that fit a w x h box inside a
+// size x size square, centered and with its aspect ratio preserved.
+func fitRect(w, h float64, size int) (x, y, dw, dh float64) {
+	scale := float64(size) / max(w, h)
+	dw, dh = w*scale, h*scale
+	return (float64(size) - dw) / 2, (float64(size) - dh) / 2, dw, dh
+}
+
+// rasterizeSVG renders an SVG document onto a transparent square canvas,
+// scaling the viewBox to fit and centering it when the aspect ratio isn't 1:1.
+func rasterizeSVG(svgContent string, size int) (*image.RGBA, error) {
+	icon, err := oksvg.ReadIconStream(strings.NewReader(svgContent), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+
+	w, h := icon.ViewBox.W, icon.ViewBox.H
+	if w <= 0 || h <= 0 {
+		return nil, fmt.Errorf("SVG has no usable viewBox")
+	}
+
+	icon.SetTarget(fitRect(w, h, size))
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	scanner := rasterx.NewScannerGV(size, size, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(size, size, scanner), 1)
+	return img, nil
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeICO packs PNG-encoded images into an ICO container, the same layout
+// used by the ICO files in the collection.
+func encodeICO(images []image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, [3]uint16{0, 1, uint16(len(images))})
+
+	var payload bytes.Buffer
+	offset := 6 + 16*len(images)
+	for _, img := range images {
+		data, err := encodePNG(img)
+		if err != nil {
+			return nil, err
+		}
+		b := img.Bounds()
+		// Dimensions of 256 or more are stored as 0
+		buf.Write([]byte{byte(b.Dx()), byte(b.Dy()), 0, 0})
+		binary.Write(&buf, binary.LittleEndian, [2]uint16{1, 32})
+		binary.Write(&buf, binary.LittleEndian, [2]uint32{uint32(len(data)), uint32(offset + payload.Len())})
+		payload.Write(data)
+	}
+
+	buf.Write(payload.Bytes())
+	return buf.Bytes(), nil
+}
+
+// decodeICO returns the largest PNG-encoded image in an ICO container.
+func decodeICO(data []byte) (image.Image, error) {
+	if len(data) < 6 {
+		return nil, errors.New("truncated ICO header")
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:6]))
+
+	var best []byte
+	bestSize := -1
+	for i := 0; i < count; i++ {
+		entry := 6 + 16*i
+		if len(data) < entry+16 {
+			return nil, errors.New("truncated ICO directory")
+		}
+		size := int(data[entry])
+		if size == 0 {
+			size = 256
+		}
+		length := int(binary.LittleEndian.Uint32(data[entry+8 : entry+12]))
+		offset := int(binary.LittleEndian.Uint32(data[entry+12 : entry+16]))
+		if offset < 0 || length < 0 || offset+length > len(data) {
+			return nil, errors.New("ICO entry out of range")
+		}
+		if size > bestSize && bytes.HasPrefix(data[offset:offset+length], []byte("\x89PNG")) {
+			best, bestSize = data[offset:offset+length], size
+		}
+	}
+	if best == nil {
+		return nil, errors.New("ICO has no PNG-encoded images")
+	}
+	return png.Decode(bytes.NewReader(best))
+}
+
+func decodeRaster(content string) (image.Image, error) {
+	data := []byte(content)
+	if bytes.HasPrefix(data, []byte{0, 0, 1, 0}) {
+		return decodeICO(data)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
+
+// encodeImage encodes a single image as png, webp or ico.
+func encodeImage(img image.Image, format string) (string, error) {
+	switch format {
+	case "png":
+		data, err := encodePNG(img)
+		return string(data), err
+	case "webp":
+		var buf bytes.Buffer
+		if err := nativewebp.Encode(&buf, img, nil); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	case "ico":
+		data, err := encodeICO([]image.Image{img})
+		return string(data), err
+	default:
+		return "", fmt.Errorf("unsupported raster format \"%s\"", format)
+	}
+}
+
+// renderSVG converts SVG content into the requested raster format. Supported
+// formats are png, webp and ico; callers are expected to map anything else
+// (avif) to one of these beforehand. A size of 0 renders at the collection's
+// native dimensions (every ICO size, or rasterSize for the rest).
+func renderSVG(svgContent, format string, size int) (string, error) {
+	if format == "ico" && size == 0 {
+		images := make([]image.Image, 0, len(icoSizes))
+		for _, size := range icoSizes {
+			img, err := rasterizeSVG(svgContent, size)
+			if err != nil {
+				return "", err
+			}
+			images = append(images, img)
+		}
+		data, err := encodeICO(images)
+		return string(data), err
+	}
+
+	if size == 0 {
+		size = rasterSize
+	}
+	img, err := rasterizeSVG(svgContent, size)
+	if err != nil {
+		return "", err
+	}
+	return encodeImage(img, format)
+}
+
+// resizeRaster resamples a PNG, WebP or ICO file to a size x size square and
+// re-encodes it in the requested format.
+func resizeRaster(content, format string, size int) (string, error) {
+	src, err := decodeRaster(content)
+	if err != nil {
+		return "", err
+	}
+
+	b := src.Bounds()
+	x, y, dw, dh := fitRect(float64(b.Dx()), float64(b.Dy()), size)
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	target := image.Rect(int(x), int(y), int(x+dw+0.5), int(y+dh+0.5))
+	draw.CatmullRom.Scale(dst, target, src, b, draw.Over, nil)
+
+	return encodeImage(dst, format)
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/colornames"
+)
+
+// paintProperties are the properties, as presentation attributes or in CSS,
+// whose value is a color.
+var paintProperties = map[string]bool{
+	"fill":           true,
+	"stroke":         true,
+	"color":          true,
+	"stop-color":     true,
+	"flood-color":    true,
+	"lighting-color": true,
+	"solid-color":    true,
+}
+
+// colorMapMaxPairs limits the number of pairs in a ?map= color mapping.
+const colorMapMaxPairs = 16
+
+// colorToken is a color found in an SVG, along with the alpha it was written
+// with so a replacement can keep it: hexAlpha holds the alpha digits of a
+// #rgba/#rrggbbaa value, and funcAlpha the alpha argument of rgba() and
+// friends.
+type colorToken struct {
+	Text      string
+	R, G, B   uint8
+	hexAlpha  string
+	funcAlpha string
+}
+
+// withRGB returns the color code, given as 6 hex digits, in place of this
+// token, keeping its alpha channel.
+func (c colorToken) withRGB(code string) string {
+	switch {
+	case c.hexAlpha != "":
+		return "#" + code + c.hexAlpha
+	case c.funcAlpha != "":
+		r, g, b := hexRGB(code)
+		return fmt.Sprintf("rgba(%d, %d, %d, %s)", r, g, b, c.funcAlpha)
+	default:
+		return "#" + code
+	}
+}
+
+// colorReplacer decides the replacement for a color, if any.
+type colorReplacer func(colorToken) (string, bool)
+
+func hexRGB(code string) (int64, int64, int64) {
+	r, _ := strconv.ParseInt(code[0:2], 16, 0)
+	g, _ := strconv.ParseInt(code[2:4], 16, 0)
+	b, _ := strconv.ParseInt(code[4:6], 16, 0)
+	return r, g, b
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func isIdentByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_'
+}
+
+// parseHexColor parses the digits of a #rgb, #rgba, #rrggbb or #rrggbbaa
+// color. The odd 7-digit form is read as #rrggbb plus an alpha nibble.
+func parseHexColor(digits string) (colorToken, bool) {
+	expand := func(s string) uint8 {
+		n, _ := strconv.ParseUint(s, 16, 8)
+		return uint8(n)
+	}
+	h := strings.ToLower(digits)
+	c := colorToken{Text: "#" + digits}
+	switch len(h) {
+	case 3, 4:
+		c.R, c.G, c.B = expand(strings.Repeat(h[0:1], 2)), expand(strings.Repeat(h[1:2], 2)), expand(strings.Repeat(h[2:3], 2))
+		if len(h) == 4 {
+			c.hexAlpha = strings.Repeat(h[3:4], 2)
+		}
+	case 6, 7, 8:
+		c.R, c.G, c.B = expand(h[0:2]), expand(h[2:4]), expand(h[4:6])
+		if len(h) == 7 {
+			c.hexAlpha = strings.Repeat(h[6:7], 2)
+		} else if len(h) == 8 {
+			c.hexAlpha = h[6:8]
+		}
+	default:
+		return colorToken{}, false
+	}
+	return c, true
+}
+
+// parseColorFunc parses rgb(), rgba(), hsl() and hsla() in both the comma
+// and space separated syntaxes.
+func parseColorFunc(name, args string) (colorToken, bool) {
+	parts := strings.FieldsFunc(args, func(r rune) bool {
+		return r == ',' || r == '/' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	if len(parts) != 3 && len(parts) != 4 {
+		return colorToken{}, false
+	}
+	c := colorToken{Text: name + "(" + args + ")"}
+	if len(parts) == 4 {
+		c.funcAlpha = parts[3]
+	}
+
+	// component reads a number or percentage, scaled so that 100% is max
+	component := func(s string, max float64) (float64, bool) {
+		if p, ok := strings.CutSuffix(s, "%"); ok {
+			f, err := strconv.ParseFloat(p, 64)
+			return f / 100 * max, err == nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		return f, err == nil
+	}
+	clamp := func(f float64) uint8 {
+		return uint8(math.Round(math.Max(0, math.Min(255, f))))
+	}
+
+	switch strings.ToLower(name) {
+	case "rgb", "rgba":
+		var rgb [3]uint8
+		for i := range rgb {
+			f, ok := component(parts[i], 255)
+			if !ok {
+				return colorToken{}, false
+			}
+			rgb[i] = clamp(f)
+		}
+		c.R, c.G, c.B = rgb[0], rgb[1], rgb[2]
+	case "hsl", "hsla":
+		h, err := strconv.ParseFloat(strings.TrimSuffix(parts[0], "deg"), 64)
+		s, okS := component(parts[1], 1)
+		l, okL := component(parts[2], 1)
+		if err != nil || !okS || !okL {
+			return colorToken{}, false
+		}
+		r, g, b := hslToRGB(h, s, l)
+		c.R, c.G, c.B = clamp(r*255), clamp(g*255), clamp(b*255)
+	default:
+		return colorToken{}, false
+	}
+	return c, true
+}
+
+func hslToRGB(h, s, l float64) (float64, float64, float64) {
+	h = math.Mod(math.Mod(h, 360)+360, 360) / 360
+	if s == 0 {
+		return l, l, l
+	}
+	q := l + s - l*s
+	if l < 0.5 {
+		q = l * (1 + s)
+	}
+	p := 2*l - q
+	hue := func(t float64) float64 {
+		t = math.Mod(t+1, 1)
+		switch {
+		case t < 1.0/6:
+			return p + (q-p)*6*t
+		case t < 0.5:
+			return q
+		case t < 2.0/3:
+			return p + (q-p)*(2.0/3-t)*6
+		default:
+			return p
+		}
+	}
+	return hue(h + 1.0/3), hue(h), hue(h - 1.0/3)
+}
+
+// recolorValue replaces the colors in a CSS value, such as "#fff",
+// "url(#grad) white" or "var(--fg, rgb(255 255 255 / 50%))". References
+// inside url() are never mistaken for colors.
+func recolorValue(value string, replace colorReplacer) string {
+	var b strings.Builder
+	for i := 0; i < len(value); {
+		c := value[i]
+		switch {
+		case c == '#':
+			j := i + 1
+			for j < len(value) && isHexDigit(value[j]) {
+				j++
+			}
+			if j < len(value) && isIdentByte(value[j]) {
+				break
+			}
+			if tok, ok := parseHexColor(value[i+1 : j]); ok {
+				if out, ok := replace(tok); ok {
+					b.WriteString(out)
+					i = j
+					continue
+				}
+			}
+			b.WriteString(value[i:j])
+			i = j
+			continue
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(value[i+1:], c)
+			if end < 0 {
+				b.WriteString(value[i:])
+				return b.String()
+			}
+			b.WriteString(value[i : i+end+2])
+			i += end + 2
+			continue
+		case isIdentByte(c) && (i == 0 || !isIdentByte(value[i-1])):
+			j := i
+			for j < len(value) && isIdentByte(value[j]) {
+				j++
+			}
+			name := value[i:j]
+			if j < len(value) && value[j] == '(' {
+				end := strings.IndexByte(value[j:], ')')
+				if end < 0 {
+					b.WriteString(value[i:])
+					return b.String()
+				}
+				switch strings.ToLower(name) {
+				case "url":
+					b.WriteString(value[i : j+end+1])
+					i = j + end + 1
+					continue
+				case "rgb", "rgba", "hsl", "hsla":
+					if tok, ok := parseColorFunc(name, value[j+1:j+end]); ok {
+						if out, ok := replace(tok); ok {
+							b.WriteString(out)
+							i = j + end + 1
+							continue
+						}
+					}
+					b.WriteString(value[i : j+end+1])
+					i = j + end + 1
+					continue
+				}
+				// Other functions like var() are scanned for colors inside
+				b.WriteString(value[i : j+1])
+				i = j + 1
+				continue
+			}
+			if named, ok := colornames.Map[strings.ToLower(name)]; ok {
+				if out, ok := replace(colorToken{Text: name, R: named.R, G: named.G, B: named.B}); ok {
+					b.WriteString(out)
+					i = j
+					continue
+				}
+			}
+			b.WriteString(name)
+			i = j
+			continue
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return b.String()
+}
+
+// recolorCSS replaces paint colors in a stylesheet or in the declarations of
+// a style attribute. Custom properties are recolored too, since they usually
+// feed a paint property through var().
+func recolorCSS(css string, replace colorReplacer) string {
+	var b strings.Builder
+	start := 0
+	flush := func(end int) {
+		segment := css[start:end]
+		// Skip comments ahead of the property name
+		decl := 0
+		for {
+			rest := strings.TrimLeft(segment[decl:], " \t\r\n")
+			decl = len(segment) - len(rest)
+			if !strings.HasPrefix(rest, "/*") {
+				break
+			}
+			close := strings.Index(rest, "*/")
+			if close < 0 {
+				decl = len(segment)
+				break
+			}
+			decl += close + 2
+		}
+		if colon := strings.IndexByte(segment[decl:], ':'); colon >= 0 {
+			colon += decl
+			prop := strings.ToLower(strings.TrimSpace(segment[decl:colon]))
+			if paintProperties[prop] || strings.HasPrefix(prop, "--") {
+				segment = segment[:colon+1] + recolorValue(segment[colon+1:], replace)
+			}
+		}
+		b.WriteString(segment)
+		start = end
+	}
+
+	depth := 0
+	for i := 0; i < len(css); i++ {
+		switch css[i] {
+		case '/':
+			if strings.HasPrefix(css[i:], "/*") {
+				if end := strings.Index(css[i+2:], "*/"); end >= 0 {
+					i += end + 3
+				} else {
+					i = len(css) - 1
+				}
+			}
+		case '"', '\'':
+			if end := strings.IndexByte(css[i+1:], css[i]); end >= 0 {
+				i += end + 1
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+			}
+		case '{':
+			// A selector or at-rule prelude, never a declaration
+			if depth == 0 {
+				b.WriteString(css[start : i+1])
+				start = i + 1
+			}
+		case ';', '}':
+			if depth == 0 {
+				flush(i)
+				b.WriteByte(css[i])
+				start = i + 1
+			}
+		}
+	}
+	flush(len(css))
+	return b.String()
+}
+
+// recolorTag replaces paint colors in the attributes of a start tag,
+// including its style attribute, leaving the rest of the tag untouched.
+func recolorTag(tag string, replace colorReplacer) string {
+	return rewriteAttrs(tag, func(name, value string) (string, bool) {
+		switch {
+		case paintProperties[name]:
+			return recolorValue(value, replace), true
+		case name == "style":
+			return recolorCSS(value, replace), true
+		}
+		return value, true
+	})
+}
+
+// rewriteAttrs passes the quoted attribute values of a start tag through
+// rewrite, by lowercased name, dropping the attributes it returns false for.
+// Everything else in the tag is copied as is.
+func rewriteAttrs(tag string, rewrite func(name, value string) (string, bool)) string {
+	var b strings.Builder
+	i := 1
+	for i < len(tag) && !isSpace(tag[i]) && tag[i] != '>' && tag[i] != '/' {
+		i++
+	}
+	b.WriteString(tag[:i])
+
+	for i < len(tag) {
+		// Attribute name
+		j := i
+		for j < len(tag) && isSpace(tag[j]) {
+			j++
+		}
+		k := j
+		for k < len(tag) && !isSpace(tag[k]) && tag[k] != '=' && tag[k] != '>' && tag[k] != '/' {
+			k++
+		}
+		if k == j {
+			b.WriteString(tag[i : j+1])
+			i = j + 1
+			continue
+		}
+		name := strings.ToLower(tag[j:k])
+
+		// Optional quoted value
+		v := k
+		for v < len(tag) && isSpace(tag[v]) {
+			v++
+		}
+		if v >= len(tag) || tag[v] != '=' {
+			b.WriteString(tag[i:k])
+			i = k
+			continue
+		}
+		v++
+		for v < len(tag) && isSpace(tag[v]) {
+			v++
+		}
+		if v >= len(tag) || (tag[v] != '"' && tag[v] != '\'') {
+			b.WriteString(tag[i:v])
+			i = v
+			continue
+		}
+		end := strings.IndexByte(tag[v+1:], tag[v])
+		if end < 0 {
+			b.WriteString(tag[i:])
+			break
+		}
+		value, keep := rewrite(name, tag[v+1:v+1+end])
+		if keep {
+			b.WriteString(tag[i : v+1])
+			b.WriteString(value)
+			b.WriteByte(tag[v])
+		}
+		i = v + end + 2
+	}
+	return b.String()
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// tagName returns the local name of the element a tag opens or closes.
+func tagName(tag string) string {
+	name := strings.TrimLeft(tag, "</")
+	if i := strings.IndexFunc(name, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '>' || r == '/'
+	}); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.ToLower(name)
+}
+
+// indexTagEnd returns the index of the '>' closing a tag, skipping quoted
+// attribute values.
+func indexTagEnd(s string) int {
+	var quote byte
+	for i := 1; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == '>':
+			return i
+		}
+	}
+	return -1
+}
+
+// recolorSVG walks an SVG document and passes every color used as paint to
+// replace: presentation attributes, style attributes, and the stylesheets in
+// <style> elements, CDATA or not. Everything else is copied byte for byte.
+func recolorSVG(svg string, replace colorReplacer) string {
+	return walkSVG(svg,
+		func(tag string) string { return recolorTag(tag, replace) },
+		func(css string) string { return recolorCSS(css, replace) },
+	)
+}
+
+// walkSVG copies an SVG document, passing every start tag through
+// rewriteTag and the text of <style> elements, CDATA or not, through
+// rewriteStyle. Comments, processing instructions, the DOCTYPE and text are
+// copied byte for byte.
+func walkSVG(svg string, rewriteTag, rewriteStyle func(string) string) string {
+	var b strings.Builder
+	b.Grow(len(svg))
+	inStyle := false
+	writeText := func(text string) {
+		if inStyle {
+			b.WriteString(rewriteStyle(text))
+		} else {
+			b.WriteString(text)
+		}
+	}
+
+	for i := 0; i < len(svg); {
+		lt := strings.IndexByte(svg[i:], '<')
+		if lt < 0 {
+			writeText(svg[i:])
+			break
+		}
+		writeText(svg[i : i+lt])
+		i += lt
+		rest := svg[i:]
+
+		// Unterminated markup is copied as is
+		end := -1
+		switch {
+		case strings.HasPrefix(rest, "<!--"):
+			if end = strings.Index(rest, "-->"); end >= 0 {
+				end += 3
+				b.WriteString(rest[:end])
+			}
+		case strings.HasPrefix(rest, "<![CDATA["):
+			if end = strings.Index(rest, "]]>"); end >= 0 {
+				b.WriteString("<![CDATA[")
+				writeText(rest[9:end])
+				b.WriteString("]]>")
+				end += 3
+			}
+		case strings.HasPrefix(rest, "<?"):
+			if end = strings.Index(rest, "?>"); end >= 0 {
+				end += 2
+				b.WriteString(rest[:end])
+			}
+		case strings.HasPrefix(rest, "<!"):
+			// DOCTYPE, possibly with an internal subset in brackets
+			if open := strings.IndexByte(rest, '['); open >= 0 && open < strings.IndexByte(rest, '>') {
+				if close := strings.Index(rest, "]>"); close >= 0 {
+					end = close + 2
+				}
+			} else if end = strings.IndexByte(rest, '>'); end >= 0 {
+				end++
+			}
+			if end >= 0 {
+				b.WriteString(rest[:end])
+			}
+		case strings.HasPrefix(rest, "</"):
+			if end = strings.IndexByte(rest, '>'); end >= 0 {
+				end++
+				if tagName(rest[:end]) == "style" {
+					inStyle = false
+				}
+				b.WriteString(rest[:end])
+			}
+		default:
+			if end = indexTagEnd(rest); end >= 0 {
+				end++
+				tag := rest[:end]
+				b.WriteString(rewriteTag(tag))
+				if tagName(tag) == "style" && !strings.HasSuffix(tag, "/>") {
+					inStyle = true
+				}
+			}
+		}
+		if end < 0 {
+			b.WriteString(rest)
+			break
+		}
+		i += end
+	}
+	return b.String()
+}
+
+// replaceWhite recolors white to the given color code, keeping alpha.
+func replaceWhite(code string) colorReplacer {
+	return func(c colorToken) (string, bool) {
+		if c.R != 255 || c.G != 255 || c.B != 255 {
+			return "", false
+		}
+		return c.withRGB(code), true
+	}
+}
+
+// applySVGColor recolors every white paint in an SVG to the color code.
+func applySVGColor(svgContent, colorCode string) string {
+	return recolorSVG(svgContent, replaceWhite(colorCode))
+}
+
+var fillAttrRe = regexp.MustCompile(`(?i)\sfill\s*=`)
+
+// setDefaultFill gives the root <svg> element a fill attribute, unless it has
+// one, so elements that inherit the initial black fill use color instead.
+// Any fill set in CSS or further down the tree still takes precedence.
+func setDefaultFill(svg, color string) string {
+	start, end := rootSVGTag(svg)
+	if start < 0 || fillAttrRe.MatchString(svg[start:end]) {
+		return svg
+	}
+	insert := start + len("<svg")
+	return svg[:insert] + ` fill="` + color + `"` + svg[insert:]
+}
+
+// rootSVGTag returns the bounds of the root <svg> start tag, or -1 if there
+// is none.
+func rootSVGTag(svg string) (start, end int) {
+	for i := 0; i < len(svg); {
+		at := strings.Index(svg[i:], "<svg")
+		if at < 0 {
+			break
+		}
+		i += at
+		end := indexTagEnd(svg[i:])
+		if end < 0 {
+			break
+		}
+		if tagName(svg[i:i+end+1]) == "svg" {
+			return i, i + end + 1
+		}
+		i += len("<svg")
+	}
+	return -1, -1
+}
+
+// colorPair maps colors near From to the color code To.
+type colorPair struct {
+	From [3]uint8
+	To   string
+}
+
+// parseColorMap parses a mapping such as "000000:ff0000,2d2d2d:00ff00".
+// Source colors may also be 3-digit hex or color keywords.
+func parseColorMap(spec string) ([]colorPair, error) {
+	var pairs []colorPair
+	for _, entry := range strings.Split(spec, ",") {
+		from, to, found := strings.Cut(strings.TrimSpace(entry), ":")
+		from, to = strings.TrimPrefix(from, "#"), strings.ToLower(strings.TrimPrefix(to, "#"))
+		if !found || !isValidHexColor(to) {
+			return nil, fmt.Errorf("invalid mapping \"%s\"", entry)
+		}
+		var pair colorPair
+		if named, ok := colornames.Map[strings.ToLower(from)]; ok {
+			pair.From = [3]uint8{named.R, named.G, named.B}
+		} else if c, ok := parseHexColor(from); ok && (len(from) == 3 || len(from) == 6) {
+			pair.From = [3]uint8{c.R, c.G, c.B}
+		} else {
+			return nil, fmt.Errorf("invalid source color \"%s\"", from)
+		}
+		pair.To = to
+		pairs = append(pairs, pair)
+	}
+	if len(pairs) > colorMapMaxPairs {
+		return nil, fmt.Errorf("too many mappings, the limit is %d", colorMapMaxPairs)
+	}
+	return pairs, nil
+}
+
+// replaceMapped recolors every color within tolerance of a mapped source
+// color, per channel, choosing the closest source when several match.
+func replaceMapped(pairs []colorPair, tolerance int) colorReplacer {
+	return func(c colorToken) (string, bool) {
+		best, bestDistance := -1, tolerance+1
+		for i, pair := range pairs {
+			distance := max(
+				absDiff(c.R, pair.From[0]),
+				absDiff(c.G, pair.From[1]),
+				absDiff(c.B, pair.From[2]),
+			)
+			if distance < bestDistance {
+				best, bestDistance = i, distance
+			}
+		}
+		if best < 0 {
+			return "", false
+		}
+		return c.withRGB(pairs[best].To), true
+	}
+}
+
+func absDiff(a, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
+
+// iconRecolor describes how a requested icon is recolored: white in the
+// -light variant becomes Color (black in the -dark variant when Dark is set,
+// for light backgrounds), or the colors of the standard SVG are swapped
+// according to Map, matching within Tolerance.
+type iconRecolor struct {
+	Color     string
+	Dark      bool
+	Map       []colorPair
+	Tolerance int
+}
+
+func (rc iconRecolor) active() bool {
+	return rc.Color != "" || len(rc.Map) > 0
+}
+
+// sourceName returns the name of the SVG the recolor starts from.
+func (rc iconRecolor) sourceName(name string) string {
+	switch {
+	case rc.Color != "" && rc.Dark:
+		return name + "-dark"
+	case rc.Color != "":
+		return name + "-light"
+	default:
+		return name
+	}
+}
+
+func (rc iconRecolor) apply(svg string) string {
+	switch {
+	case rc.Color != "" && rc.Dark:
+		return applyColorMap(svg, []colorPair{{To: rc.Color}}, 0)
+	case rc.Color != "":
+		return applySVGColor(svg, rc.Color)
+	default:
+		return applyColorMap(svg, rc.Map, rc.Tolerance)
+	}
+}
+
+// applyColorMap recolors the paints of an SVG according to pairs.
+func applyColorMap(svg string, pairs []colorPair, tolerance int) string {
+	replace := replaceMapped(pairs, tolerance)
+	svg = recolorSVG(svg, replace)
+	// Shapes without a fill are painted black, so a mapping for black has to
+	// cover them as well
+	if fill, ok := replace(colorToken{Text: "black"}); ok {
+		svg = setDefaultFill(svg, fill)
+	}
+	return svg
+}
+
+// key identifies the recolor within a cache key, or is empty for none.
+func (rc iconRecolor) key() string {
+	if rc.Color != "" && rc.Dark {
+		return "dark=" + rc.Color
+	}
+	if rc.Color != "" || len(rc.Map) == 0 {
+		return rc.Color
+	}
+	return "map=" + rc.mapString()
+}
+
+func (rc iconRecolor) mapString() string {
+	parts := make([]string, len(rc.Map))
+	for i, pair := range rc.Map {
+		parts[i] = fmt.Sprintf("%02x%02x%02x>%s", pair.From[0], pair.From[1], pair.From[2], pair.To)
+	}
+	s := strings.Join(parts, ",")
+	if rc.Tolerance > 0 {
+		s += "~" + strconv.Itoa(rc.Tolerance)
+	}
+	return s
+}
+
+// describe returns the recolor for log messages.
+func (rc iconRecolor) describe() string {
+	switch {
+	case rc.Color != "" && rc.Dark:
+		return " with color " + rc.Color + " (dark base)"
+	case rc.Color != "":
+		return " with color " + rc.Color
+	case len(rc.Map) > 0:
+		return " with color map " + rc.mapString()
+	default:
+		return ""
+	}
+}
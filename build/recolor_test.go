@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplySVGColor(t *testing.T) {
+	tests := []struct {
+		name string
+		svg  string
+		want string
+	}{
+		{
+			name: "short hex",
+			svg:  `<svg><path fill="#fff"/></svg>`,
+			want: `<svg><path fill="#ff0000"/></svg>`,
+		},
+		{
+			name: "hex with alpha nibble",
+			svg:  `<svg><path fill="#ffff"/></svg>`,
+			want: `<svg><path fill="#ff0000ff"/></svg>`,
+		},
+		{
+			name: "hex with alpha byte",
+			svg:  `<svg><path fill="#FFFFFFCC"/></svg>`,
+			want: `<svg><path fill="#ff0000cc"/></svg>`,
+		},
+		{
+			name: "rgba keeps alpha",
+			svg:  `<svg><path fill="rgba(255, 255, 255, 0.5)"/></svg>`,
+			want: `<svg><path fill="rgba(255, 0, 0, 0.5)"/></svg>`,
+		},
+		{
+			name: "keyword",
+			svg:  `<svg><path fill="White"/></svg>`,
+			want: `<svg><path fill="#ff0000"/></svg>`,
+		},
+		{
+			name: "other colors untouched",
+			svg:  `<svg><path fill="#fefefe" stroke="black"/></svg>`,
+			want: `<svg><path fill="#fefefe" stroke="black"/></svg>`,
+		},
+		{
+			name: "stroke and flood-color",
+			svg:  `<svg><path stroke="#fff"/><feFlood flood-color="white"/></svg>`,
+			want: `<svg><path stroke="#ff0000"/><feFlood flood-color="#ff0000"/></svg>`,
+		},
+		{
+			name: "style attribute",
+			svg:  `<svg><path style="opacity:.5;fill:#fff;stroke:rgb(255 255 255 / 40%)"/></svg>`,
+			want: `<svg><path style="opacity:.5;fill:#ff0000;stroke:rgba(255, 0, 0, 40%)"/></svg>`,
+		},
+		{
+			name: "style element",
+			svg:  `<svg><style>.a{fill:#fff}/* #fff */.b{stroke:white;font-family:white}</style></svg>`,
+			want: `<svg><style>.a{fill:#ff0000}/* #fff */.b{stroke:#ff0000;font-family:white}</style></svg>`,
+		},
+		{
+			name: "CDATA stylesheet",
+			svg:  `<svg><style><![CDATA[.a{fill:#fff}]]></style></svg>`,
+			want: `<svg><style><![CDATA[.a{fill:#ff0000}]]></style></svg>`,
+		},
+		{
+			name: "url references are not colors",
+			svg:  `<svg><path fill="url(#fff) white"/></svg>`,
+			want: `<svg><path fill="url(#fff) #ff0000"/></svg>`,
+		},
+		{
+			name: "var fallback and custom property",
+			svg:  `<svg><path style="--fg:#fff;fill:var(--fg, white)"/></svg>`,
+			want: `<svg><path style="--fg:#ff0000;fill:var(--fg, #ff0000)"/></svg>`,
+		},
+		{
+			name: "non-paint attributes and comments untouched",
+			svg:  `<svg><!-- fill="#fff" --><text data-fill="#fff">white</text></svg>`,
+			want: `<svg><!-- fill="#fff" --><text data-fill="#fff">white</text></svg>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applySVGColor(tt.svg, "ff0000"); got != tt.want {
+				t.Errorf("applySVGColor()\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyColorMap(t *testing.T) {
+	tests := []struct {
+		name      string
+		spec      string
+		tolerance int
+		svg       string
+		want      string
+	}{
+		{
+			name: "hex, rgb and keyword forms",
+			spec: "000000:ff0000",
+			svg:  `<svg fill="none"><path fill="#000"/><path fill="rgb(0,0,0)"/><path fill="black"/></svg>`,
+			want: `<svg fill="none"><path fill="#ff0000"/><path fill="#ff0000"/><path fill="#ff0000"/></svg>`,
+		},
+		{
+			name: "unfilled shapes are black",
+			spec: "black:00ff00",
+			svg:  `<svg viewBox="0 0 1 1"><path/></svg>`,
+			want: `<svg fill="#00ff00" viewBox="0 0 1 1"><path/></svg>`,
+		},
+		{
+			name:      "within tolerance",
+			spec:      "2d2d2d:00ff00",
+			tolerance: 8,
+			svg:       `<svg fill="none"><path fill="#333"/><path fill="#3a3a3a"/></svg>`,
+			want:      `<svg fill="none"><path fill="#00ff00"/><path fill="#3a3a3a"/></svg>`,
+		},
+		{
+			name: "several pairs",
+			spec: "fff:000000,000:ffffff",
+			svg:  `<svg fill="none"><path fill="#fff" stroke="#000"/></svg>`,
+			want: `<svg fill="none"><path fill="#000000" stroke="#ffffff"/></svg>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pairs, err := parseColorMap(tt.spec)
+			if err != nil {
+				t.Fatalf("parseColorMap(%q): %v", tt.spec, err)
+			}
+			recolor := iconRecolor{Map: pairs, Tolerance: tt.tolerance}
+			if got := recolor.apply(tt.svg); got != tt.want {
+				t.Errorf("apply()\n got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseColorMapInvalid(t *testing.T) {
+	for _, spec := range []string{"", "000000", "zz:ff0000", "000:red", "000:ff00", strings.Repeat("000:ffffff,", 17)} {
+		if _, err := parseColorMap(spec); err == nil {
+			t.Errorf("parseColorMap(%q) succeeded, want an error", spec)
+		}
+	}
+}
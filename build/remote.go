@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Backoff between retries of a transient failure doubles from
+// remoteRetryBase up to remoteRetryMax, with jitter.
+const (
+	remoteRetryBase = 200 * time.Millisecond
+	remoteRetryMax  = 2 * time.Second
+)
+
+// RemoteObject is a fetched remote body along with the upstream headers worth
+// keeping. Mirror is the base URL that served it, FromDisk is set when it was
+// served by the disk cache tier, and NotModified when a conditional request
+// came back 304 without a body.
+type RemoteObject struct {
+	Content      string
+	ContentType  string
+	ETag         string
+	LastModified string
+	MaxAge       time.Duration
+	Mirror       string
+	FromDisk     bool
+	NotModified  bool
+}
+
+// errRemoteNotFound is returned when the upstream answers 404, as opposed to
+// failing in a way that says nothing about whether the file exists.
+var errRemoteNotFound = errors.New("not found upstream")
+
+// errRemoteRejected is returned for a response that is too large or isn't
+// the file type it claims to be, such as a captive portal page. It counts
+// against the mirror that sent it rather than as a miss.
+var errRemoteRejected = errors.New("rejected upstream response")
+
+func isRemoteMiss(err error) bool {
+	return errors.Is(err, errRemoteNotFound)
+}
+
+// httpStatusError is returned for any other unexpected upstream status.
+type httpStatusError struct {
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d", e.code)
+}
+
+// isTransient reports whether a failed request is worth retrying: server
+// errors, rate limiting, timeouts and dropped connections.
+func isTransient(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= http.StatusInternalServerError || statusErr.code == http.StatusTooManyRequests
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func retryDelay(attempt int) time.Duration {
+	backoff := min(remoteRetryBase<<attempt, remoteRetryMax)
+	return backoff/2 + rand.N(backoff/2)
+}
+
+func fetchRemoteFile(ctx context.Context, path string) (string, error) {
+	obj, err := fetchRemoteObject(ctx, path)
+	return obj.Content, err
+}
+
+// fetchRemoteObject fetches a path relative to the collection root from the
+// mirrors, consulting the disk cache first when one is configured and storing
+// successful responses in it. An expired disk entry is revalidated with a
+// conditional request rather than downloaded again.
+func fetchRemoteObject(ctx context.Context, path string) (RemoteObject, error) {
+	var stored RemoteObject
+	if diskCache != nil {
+		obj, fresh, found := diskCache.Get(path)
+		if found && fresh {
+			obj.FromDisk = true
+			return obj, nil
+		}
+		if found {
+			stored = obj
+		}
+	}
+
+	obj, err := mirrors.request(ctx, path, stored.ETag, stored.LastModified)
+	if err != nil {
+		// An expired copy beats an error while the mirrors are failing
+		if stored.Content != "" && !isRemoteMiss(err) && !errors.Is(err, context.Canceled) {
+			logf(logLevelError, "[WARN] Serving expired disk cache entry %s: %v", path, err)
+			stored.FromDisk = true
+			return stored, nil
+		}
+		return RemoteObject{}, err
+	}
+
+	if obj.NotModified {
+		stored.MaxAge = obj.MaxAge
+		if obj.ETag != "" {
+			stored.ETag = obj.ETag
+		}
+		if obj.LastModified != "" {
+			stored.LastModified = obj.LastModified
+		}
+		diskCache.Set(path, stored)
+		stored.Mirror = obj.Mirror
+		stored.FromDisk = true
+		logf(logLevelDebug, "[CACHE] Revalidated disk cache entry: %s (%s)", path, obj.Mirror)
+		return stored, nil
+	}
+
+	if diskCache != nil {
+		diskCache.Set(path, obj)
+	}
+	return obj, nil
+}
+
+// requestRemote performs a GET that is made conditional when an ETag or
+// Last-Modified value is given, in which case a 304 is reported through
+// NotModified rather than as an error.
+func requestRemote(ctx context.Context, url, etag, lastModified string) (RemoteObject, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return RemoteObject{}, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	release, err := upstreamLimiter.acquire(ctx)
+	if err != nil {
+		return RemoteObject{}, err
+	}
+	defer release()
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return RemoteObject{}, err
+	}
+	defer resp.Body.Close()
+
+	obj := RemoteObject{
+		ContentType:  resp.Header.Get("Content-Type"),
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		MaxAge:       parseMaxAge(resp.Header.Get("Cache-Control")),
+	}
+
+	if resp.StatusCode == http.StatusNotModified && (etag != "" || lastModified != "") {
+		obj.NotModified = true
+		return obj, nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return RemoteObject{}, errRemoteNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return RemoteObject{}, &httpStatusError{resp.StatusCode}
+	}
+
+	if resp.ContentLength > config.RemoteMaxBytes {
+		return RemoteObject{}, fmt.Errorf("%w: body of %d bytes exceeds %s", errRemoteRejected, resp.ContentLength, formatBytes(config.RemoteMaxBytes))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, config.RemoteMaxBytes+1))
+	if err != nil {
+		return RemoteObject{}, err
+	}
+	if int64(len(data)) > config.RemoteMaxBytes {
+		return RemoteObject{}, fmt.Errorf("%w: body exceeds %s", errRemoteRejected, formatBytes(config.RemoteMaxBytes))
+	}
+	obj.Content = string(data)
+	return obj, nil
+}
+
+// validateContent checks that a downloaded file really is the format its
+// extension says, by signature for raster formats and by parsing for SVG and
+// JSON files like index.json. Other files are passed through.
+func validateContent(content, file string) error {
+	data := []byte(content)
+	switch path.Ext(file) {
+	case ".png":
+		if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+			return errors.New("missing PNG signature")
+		}
+	case ".webp":
+		if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+			return errors.New("missing WebP signature")
+		}
+	case ".avif":
+		if len(data) < 12 || string(data[4:8]) != "ftyp" || !isAVIFBrand(data) {
+			return errors.New("missing AVIF signature")
+		}
+	case ".ico":
+		if !bytes.HasPrefix(data, []byte{0, 0, 1, 0}) {
+			return errors.New("missing ICO signature")
+		}
+	case ".svg":
+		return validateSVG(content)
+	case ".json":
+		if !json.Valid(data) {
+			return errors.New("malformed JSON")
+		}
+	}
+	return nil
+}
+
+// isAVIFBrand reports whether the ftyp box lists avif or avis as its major or
+// a compatible brand.
+func isAVIFBrand(data []byte) bool {
+	size := int(data[0])<<24 | int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if size < 16 || size > len(data) {
+		size = min(len(data), 64)
+	}
+	for i := 8; i+4 <= size; i += 4 {
+		if brand := string(data[i : i+4]); brand == "avif" || brand == "avis" {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSVG requires a well-formed XML document whose root is <svg>.
+func validateSVG(content string) error {
+	decoder := xml.NewDecoder(strings.NewReader(content))
+	root := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("malformed SVG: %v", err)
+		}
+		if start, ok := token.(xml.StartElement); ok && root == "" {
+			root = start.Name.Local
+		}
+	}
+	if root != "svg" {
+		return errors.New("document is not an SVG")
+	}
+	return nil
+}
+
+// requestWithRetry is requestRemote with up to REMOTE_RETRIES further
+// attempts for transient failures.
+func requestWithRetry(ctx context.Context, url, etag, lastModified string) (RemoteObject, error) {
+	for attempt := 0; ; attempt++ {
+		obj, err := requestRemote(ctx, url, etag, lastModified)
+		if err == nil || attempt >= config.RemoteRetries || !isTransient(err) || ctx.Err() != nil {
+			return obj, err
+		}
+		delay := retryDelay(attempt)
+		logf(logLevelDebug, "[WARN] Retrying %s in %v: %v", url, formatDuration(delay), err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return RemoteObject{}, ctx.Err()
+		}
+	}
+}
+
+// parseMaxAge extracts max-age from a Cache-Control header, returning 0 when
+// it is absent or invalid.
+func parseMaxAge(cacheControl string) time.Duration {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(directive), "=")
+		if !found || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		if n, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && n > 0 {
+			return time.Duration(n) * time.Second
+		}
+	}
+	return 0
+}
+
+// upstreamTTL returns the cache lifetime to use for a remote object: the
+// upstream max-age when USE_UPSTREAM_MAX_AGE is enabled, or 0 for CACHE_TTL.
+func upstreamTTL(maxAge time.Duration) time.Duration {
+	if config.UseUpstreamMaxAge {
+		return maxAge
+	}
+	return 0
+}
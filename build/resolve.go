@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+)
+
+// variantSuffixes are the suffixes of the light and dark variants in the collection.
+var variantSuffixes = []string{"-light", "-dark"}
+
+// Resolve maps a requested icon name to its canonical reference. Display
+// names, underscores, spaces and camelCase resolve through the normalized
+// index, and names listed in aliases.json report renamed so the caller can
+// redirect. Unknown names are returned lowercased, as before the index existed.
+func (idx *IconIndex) Resolve(name string) (string, bool) {
+	lower := strings.ToLower(name)
+	if _, ok := idx.Entries(); !ok {
+		return lower, false
+	}
+
+	slug := strings.NewReplacer("_", "-", " ", "-").Replace(lower)
+	base, variant := slug, ""
+	for _, suffix := range variantSuffixes {
+		if strings.HasSuffix(slug, suffix) {
+			base, variant = strings.TrimSuffix(slug, suffix), suffix
+			break
+		}
+	}
+
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	if _, ok := idx.byRef[lower]; ok {
+		return lower, false
+	}
+	if target, ok := idx.aliases[slug]; ok {
+		return target, true
+	}
+	if target, ok := idx.aliases[base]; ok && variant != "" {
+		return target + variant, true
+	}
+	if _, ok := idx.byRef[slug]; ok {
+		return slug, false
+	}
+	if _, ok := idx.byRef[base]; ok && variant != "" {
+		return base + variant, false
+	}
+	if i, ok := idx.byNormalized[normalizeName(slug)]; ok && i >= 0 {
+		return strings.ToLower(idx.entries[i].Reference), false
+	}
+	if i, ok := idx.byNormalized[normalizeName(base)]; ok && i >= 0 && variant != "" {
+		return strings.ToLower(idx.entries[i].Reference) + variant, false
+	}
+	return lower, false
+}
+
+// Variant returns the name of the -light or -dark variant of an icon, or the
+// name unchanged when the index says the icon doesn't come in that variant.
+// While the index is unavailable the variant is assumed to exist.
+func (idx *IconIndex) Variant(name, suffix string) string {
+	if _, ok := idx.Entries(); !ok {
+		return name + suffix
+	}
+	entry, found := idx.Lookup(name)
+	if !found || (suffix == "-light" && !entry.HasLight()) || (suffix == "-dark" && !entry.HasDark()) {
+		return name
+	}
+	return name + suffix
+}
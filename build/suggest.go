@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	// suggestMinScore is the lowest similarity listed as a suggestion.
+	suggestMinScore = 0.5
+	// suggestConfidentScore is the similarity required for ?fallback=suggest
+	// to serve a match in place of the requested icon.
+	suggestConfidentScore = 0.85
+	suggestLimit          = 5
+	// suggestMaxQuery is the longest normalized name that gets suggestions.
+	// Nothing in the collection comes close, and longer names only cost CPU.
+	suggestMaxQuery = 64
+)
+
+type Suggestion struct {
+	Reference string  `json:"reference"`
+	Name      string  `json:"name"`
+	Score     float64 `json:"score"`
+}
+
+// normalizeName reduces a name to lowercase letters and digits so that
+// separators and casing don't count against a match.
+func normalizeName(name string) string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// similarity scores two normalized names from 0 (unrelated) to 1 (identical).
+// Names whose lengths alone rule out suggestMinScore score 0 without being
+// compared.
+func similarity(a, b string) float64 {
+	if a == "" || b == "" {
+		return 0
+	}
+	la, lb := len([]rune(a)), len([]rune(b))
+	longest := max(la, lb)
+	// The edit distance is at least the difference in length
+	if 1-float64(max(la-lb, lb-la))/float64(longest) < suggestMinScore {
+		return 0
+	}
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+// suggestIcons returns the closest index entries to a missing icon name,
+// matching against both the reference slug and the display name.
+func suggestIcons(name string) []Suggestion {
+	entries, ok := iconIndex.Entries()
+	if !ok {
+		return nil
+	}
+
+	query := normalizeName(name)
+	if len(query) > suggestMaxQuery {
+		return nil
+	}
+	var suggestions []Suggestion
+	for _, e := range entries {
+		score := max(similarity(query, normalizeName(e.Reference)), similarity(query, normalizeName(e.Name)))
+		if score >= suggestMinScore {
+			suggestions = append(suggestions, Suggestion{Reference: e.Reference, Name: e.Name, Score: math.Round(score*100) / 100})
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].Score > suggestions[j].Score
+	})
+	if len(suggestions) > suggestLimit {
+		suggestions = suggestions[:suggestLimit]
+	}
+	return suggestions
+}
+
+// confidentSuggestion returns the best suggestion when it clears
+// suggestConfidentScore and isn't tied with the runner-up.
+func confidentSuggestion(suggestions []Suggestion) (Suggestion, bool) {
+	if len(suggestions) == 0 || suggestions[0].Score < suggestConfidentScore {
+		return Suggestion{}, false
+	}
+	if len(suggestions) > 1 && suggestions[1].Score == suggestions[0].Score {
+		return Suggestion{}, false
+	}
+	return suggestions[0], true
+}
+
+// writeIconNotFound answers a 404 with the closest matches from the index, as
+// JSON when the client asks for it and plain text otherwise.
+func writeIconNotFound(w http.ResponseWriter, r *http.Request, suggestions []Suggestion) {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		if suggestions == nil {
+			suggestions = []Suggestion{}
+		}
+		writeJSON(w, http.StatusNotFound, map[string]any{
+			"error":       "Icon not found",
+			"suggestions": suggestions,
+		})
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("Icon not found\n")
+	if len(suggestions) > 0 {
+		b.WriteString("\nDid you mean:\n")
+		for _, s := range suggestions {
+			fmt.Fprintf(&b, "  %s (%s)\n", s.Reference, s.Name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, b.String())
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// localWriter copies remotely fetched files into the local volume in hybrid
+// mode, so it gradually fills up with the icons that are actually used. Files
+// are written atomically and never replace existing ones, and writing stops
+// once the format directories hold maxBytes.
+type localWriter struct {
+	maxBytes int64
+	bytes    int64
+	pending  map[string]bool
+	written  map[string]bool
+	disabled bool
+	mutex    sync.Mutex
+}
+
+var writeThrough *localWriter
+
+// newLocalWriter measures the format directories already in the volume.
+func newLocalWriter(maxBytes int64) *localWriter {
+	w := &localWriter{maxBytes: maxBytes, pending: make(map[string]bool), written: make(map[string]bool)}
+	for _, format := range []string{"svg", "png", "webp", "avif", "ico"} {
+		dir := filepath.Join(config.LocalPath, format)
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			// Leftovers from writes interrupted by a crash or restart
+			if strings.HasPrefix(f.Name(), ".tmp-") {
+				os.Remove(filepath.Join(dir, f.Name()))
+				continue
+			}
+			if info, err := f.Info(); err == nil && !f.IsDir() {
+				w.bytes += info.Size()
+			}
+		}
+	}
+	return w
+}
+
+// Write stores content under path, relative to the collection root, in the
+// background.
+func (w *localWriter) Write(path, content string) {
+	w.mutex.Lock()
+	if w.disabled || w.pending[path] || w.bytes+int64(len(content)) > w.maxBytes {
+		w.mutex.Unlock()
+		return
+	}
+	w.pending[path] = true
+	w.bytes += int64(len(content))
+	w.mutex.Unlock()
+
+	go func() {
+		err := w.write(path, content)
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		delete(w.pending, path)
+		if err == nil {
+			w.written[path] = true
+			logf(logLevelDebug, "[CACHE] Saved remote icon to local volume: %s", path)
+			return
+		}
+		w.bytes -= int64(len(content))
+		if os.IsExist(err) {
+			return
+		}
+		if os.IsPermission(err) {
+			// A read-only volume won't get better, so stop trying
+			w.disabled = true
+			logf(logLevelError, "[WARN] Local volume is not writable, disabling LOCAL_WRITE_THROUGH: %v", err)
+			return
+		}
+		logf(logLevelError, "[ERROR] Failed to save remote icon %s to local volume: %v", path, err)
+	}()
+}
+
+// ownWrite reports whether path was saved by the writer, so the collection
+// watcher can tell its files from ones added by hand. Each path is reported
+// once.
+func (w *localWriter) ownWrite(path string) bool {
+	if w == nil {
+		return false
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.written[path] {
+		return false
+	}
+	delete(w.written, path)
+	return true
+}
+
+func (w *localWriter) write(path, content string) error {
+	target := filepath.Join(config.LocalPath, filepath.FromSlash(path))
+	if _, err := os.Stat(target); err == nil {
+		return os.ErrExist
+	}
+	dir := filepath.Dir(target)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return writeFileAtomic(dir, filepath.Base(target), []byte(content))
+}